@@ -0,0 +1,102 @@
+package kvdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes the values of a table. Its ID is stored in every record
+// header, so records written with another codec stay readable after a
+// table switches codecs (MigrateAll rewrites them with the new one).
+// IDs below 16 are reserved for the built-in codecs.
+type Codec interface {
+	ID() byte
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+const (
+	CodecMsgpack byte = iota // 默认; 没有codec头部的记录都是msgpack
+	CodecJSON                // encoding/json
+	CodecCBOR                // RFC 8949
+	CodecProto               // protobuf, 只支持*T实现proto.Message的表
+)
+
+var (
+	MsgpackCodec Codec = msgpackCodec{}
+	JSONCodec    Codec = jsonCodec{}
+	CBORCodec    Codec = cborCodec{}
+	ProtoCodec   Codec = protoCodec{}
+)
+
+var builtinCodecs = map[byte]Codec{
+	CodecMsgpack: MsgpackCodec,
+	CodecJSON:    JSONCodec,
+	CodecCBOR:    CBORCodec,
+	CodecProto:   ProtoCodec,
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() byte                           { return CodecMsgpack }
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte                           { return CodecJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// cbor默认把map解码为map[any]any, 迁移和检查需要map[string]any
+var cborDec, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) ID() byte                           { return CodecCBOR }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cborDec.Unmarshal(data, v) }
+
+type protoCodec struct{}
+
+func (protoCodec) ID() byte { return CodecProto }
+
+func (protoCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("kvdb: proto codec cannot encode %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("kvdb: proto codec cannot decode into %T", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// checkCodec 打开表时检查codec能否编码T: ProtoCodec要求*T实现proto.Message
+func checkCodec[T any](c Codec) error {
+	if _, ok := any(new(T)).(proto.Message); !ok && c.ID() == CodecProto {
+		return fmt.Errorf("kvdb: proto codec needs a proto message type, not %T", *new(T))
+	}
+	return nil
+}
+
+// codecOf 返回编码记录时使用的codec
+func (t *TableMem[T]) codecOf(id byte) (Codec, error) {
+	if id == t.codec.ID() {
+		return t.codec, nil
+	}
+	if c, ok := builtinCodecs[id]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: unknown codec %d", errUnsupported, id)
+}
@@ -0,0 +1,87 @@
+package kvdb
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/golang/snappy"
+)
+
+// Compression selects how a table compresses record payloads. The
+// algorithm is recorded in each record header, so compressed and
+// uncompressed records coexist and the option can be changed at any time.
+type Compression byte
+
+const (
+	CompressNone   Compression = iota // 不压缩
+	CompressSnappy                    // snappy
+	CompressZstd                      // zstd, 可配合TableOptions.ZstdDicts使用训练字典
+)
+
+const defaultCompressMin = 512 // 默认只压缩不小于该长度的payload
+
+// 记录头部的压缩算法字节, zstdDict后跟4字节字典id
+const (
+	algoSnappy   byte = 1
+	algoZstd     byte = 2
+	algoZstdDict byte = 3
+)
+
+// dictID 字典的id, 写在使用字典压缩的记录头部, 读取时据此选择字典
+func dictID(dict []byte) uint32 {
+	return crc32.ChecksumIEEE(dict)
+}
+
+// compress 按表的设置压缩payload, 太短或压缩后没有变小时原样返回
+func (t *TableMem[T]) compress(h *recordHeader, payload []byte) ([]byte, error) {
+	min := is(t.opts.CompressMin > 0, t.opts.CompressMin, defaultCompressMin)
+	if t.opts.Compression == CompressNone || len(payload) < min {
+		return payload, nil
+	}
+	var out []byte
+	var err error
+	switch t.opts.Compression {
+	case CompressSnappy:
+		h.compress = algoSnappy
+		out = snappy.Encode(nil, payload)
+	case CompressZstd:
+		if len(t.opts.ZstdDicts) > 0 {
+			dict := t.opts.ZstdDicts[0]
+			h.compress, h.dict = algoZstdDict, dictID(dict)
+			out, err = zstdCompress(payload, dict)
+		} else {
+			h.compress = algoZstd
+			out, err = zstdCompress(payload, nil)
+		}
+	default:
+		return nil, fmt.Errorf("kvdb: unknown compression %d", t.opts.Compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out) >= len(payload) {
+		h.compress, h.dict = 0, 0
+		return payload, nil
+	}
+	return out, nil
+}
+
+// decompress 按记录头部解压payload
+func (t *TableMem[T]) decompress(h recordHeader, payload []byte) ([]byte, error) {
+	switch h.compress {
+	case 0:
+		return payload, nil
+	case algoSnappy:
+		return snappy.Decode(nil, payload)
+	case algoZstd:
+		return zstdDecompress(payload, nil)
+	case algoZstdDict:
+		for _, dict := range t.opts.ZstdDicts {
+			if dictID(dict) == h.dict {
+				return zstdDecompress(payload, dict)
+			}
+		}
+		return nil, fmt.Errorf("%w: unknown zstd dictionary %08x", errUnsupported, h.dict)
+	}
+	return nil, fmt.Errorf("%w: unknown compression %d", errUnsupported, h.compress)
+}
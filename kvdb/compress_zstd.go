@@ -0,0 +1,63 @@
+package kvdb
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// klauspost/compress是纯Go实现, 不用cgo编译时也能读写zstd记录.
+// Encoder和Decoder的EncodeAll/DecodeAll可以并发调用, 按字典缓存复用.
+
+var zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec} // "zstd --train"生成的字典格式
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+var zstdCodecs sync.Map // dictID -> *zstdCodec, 不用字典时key为nil字典的id
+
+func zstdFor(dict []byte) (*zstdCodec, error) {
+	id := dictID(dict)
+	if c, ok := zstdCodecs.Load(id); ok {
+		return c.(*zstdCodec), nil
+	}
+	var eo []zstd.EOption
+	var do []zstd.DOption
+	switch {
+	case dict == nil:
+	case bytes.HasPrefix(dict, zstdDictMagic):
+		eo, do = append(eo, zstd.WithEncoderDict(dict)), append(do, zstd.WithDecoderDicts(dict))
+	default:
+		// 任意内容的字典作为初始历史, 帧头中的字典id为0, 与libzstd的raw字典一致
+		eo, do = append(eo, zstd.WithEncoderDictRaw(0, dict)), append(do, zstd.WithDecoderDictRaw(0, dict))
+	}
+	enc, err := zstd.NewWriter(nil, eo...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, do...)
+	if err != nil {
+		return nil, err
+	}
+	c, _ := zstdCodecs.LoadOrStore(id, &zstdCodec{enc: enc, dec: dec})
+	return c.(*zstdCodec), nil
+}
+
+func zstdCompress(src, dict []byte) ([]byte, error) {
+	c, err := zstdFor(dict)
+	if err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func zstdDecompress(src, dict []byte) ([]byte, error) {
+	c, err := zstdFor(dict)
+	if err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(src, nil)
+}
@@ -0,0 +1,167 @@
+package kvdb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// 信封加密: 每条记录用随机生成的数据密钥(DEK)以AES-GCM加密payload,
+// DEK再用KeyProvider的当前密钥加密后和密钥id一起写入记录头部. 轮换密钥时
+// 只需让CurrentKey返回新密钥, 旧密钥继续由Key提供, Rekey在后台把旧记录
+// 改用新密钥加密, 期间读写都不受影响.
+//
+// 只加密记录的值. 记录id, 过期时间和索引key仍是明文; 开启BlindIndexes后
+// 索引key中的字段值以HMAC代替.
+
+// KeyProvider supplies the keys used to encrypt a table's records. Keys
+// must be 16, 24 or 32 bytes (AES-128/192/256).
+type KeyProvider interface {
+	CurrentKey() (id uint32, key []byte, err error) //写入新记录使用的密钥
+	Key(id uint32) (key []byte, err error)          //按id返回密钥, 用于读取旧记录
+	BlindKey() (key []byte, err error)              //BlindIndexes使用的HMAC密钥, 轮换后需要重建索引
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory.
+type StaticKeys struct {
+	Current uint32            // 当前密钥id
+	Keys    map[uint32][]byte // 所有密钥, 包含轮换前的旧密钥
+	Blind   []byte            // HMAC密钥
+}
+
+// CurrentKey implements KeyProvider.
+func (k *StaticKeys) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+// Key implements KeyProvider.
+func (k *StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("kvdb: unknown key %d", id)
+	}
+	return key, nil
+}
+
+// BlindKey implements KeyProvider.
+func (k *StaticKeys) BlindKey() ([]byte, error) {
+	if len(k.Blind) == 0 {
+		return nil, errors.New("kvdb: no blind key")
+	}
+	return k.Blind, nil
+}
+
+const dekSize = 32
+
+// seal AES-GCM加密, 返回nonce+密文
+func seal(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plain)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("kvdb: ciphertext too short")
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+// encrypt 表设置了Keys时用新的DEK加密payload
+func (t *TableMem[T]) encrypt(h *recordHeader, payload []byte) ([]byte, error) {
+	if t.opts.Keys == nil {
+		return payload, nil
+	}
+	id, kek, err := t.opts.Keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	dek := make([]byte, dekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	if h.dek, err = seal(kek, dek); err != nil {
+		return nil, err
+	}
+	h.keyID = id
+	return seal(dek, payload)
+}
+
+// decrypt 按记录头部的密钥id解密payload
+func (t *TableMem[T]) decrypt(h recordHeader, payload []byte) ([]byte, error) {
+	if h.dek == nil {
+		return payload, nil
+	}
+	if t.opts.Keys == nil {
+		return nil, fmt.Errorf("%w: encrypted record but no key provider", errUnsupported)
+	}
+	kek, err := t.opts.Keys.Key(h.keyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnsupported, err)
+	}
+	dek, err := unseal(kek, h.dek)
+	if err != nil {
+		// 密钥配置错误不是数据损坏, 不能隔离记录
+		return nil, fmt.Errorf("%w: unwrap data key %d: %w", errUnsupported, h.keyID, err)
+	}
+	return unseal(dek, payload)
+}
+
+// blinded 把索引key中prefix之后的字段值替换为16字节HMAC
+func (idx IndexInfo) blinded(key []byte) []byte {
+	if idx.blind == nil {
+		return key
+	}
+	n := len(idx.prefix())
+	mac := hmac.New(sha256.New, idx.blind)
+	mac.Write(key[n:])
+	return mac.Sum(key[:n:n])[:n+16]
+}
+
+// Rekey implements Table.
+func (t *TableMem[T]) Rekey() (RewriteResult, error) {
+	return t.rekey(context.Background())
+}
+
+func (t *TableMem[T]) rekey(ctx context.Context) (RewriteResult, error) {
+	if t.opts.Keys == nil {
+		return RewriteResult{}, newError("rekey", t.name, "", errors.New("no key provider"))
+	}
+	id, _, err := t.opts.Keys.CurrentKey()
+	if err != nil {
+		return RewriteResult{}, newError("rekey", t.name, "", err)
+	}
+	return t.rewrite(ctx, "rekey", func(h recordHeader) bool {
+		return h.dek == nil || h.keyID != id
+	})
+}
+
+// Rekey implements TableCtx.
+func (c *tableMemCtx[T]) Rekey(ctx context.Context) (RewriteResult, error) {
+	return c.t.rekey(ctx)
+}
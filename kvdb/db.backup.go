@@ -0,0 +1,348 @@
+package kvdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// 备份是pebble checkpoint的副本, 可以直接用Open(Options{Dir: dir})打开.
+// checkpoint先建在存储自己的文件系统里(磁盘上与数据文件硬链接, 几乎不占
+// 空间), 再复制到目标目录, 因此Mem模式也能备份. sst文件写入后不再修改,
+// 增量备份时Base中已有的sst直接硬链接过来, 只复制新文件.
+
+const (
+	backupStaging = "backup.tmp"  // checkpoint在存储目录下的临时位置
+	backupIDFile  = "KVDB_BACKUP" // 备份目录中记录存储标识的文件
+)
+
+// BackupOptions configures DB.Backup.
+type BackupOptions struct {
+	// Base is an earlier backup of the same DB. Table files already in
+	// Base are hard-linked instead of copied, so the new backup only
+	// costs the data written since. Each backup stays self-contained and
+	// Base can be deleted later.
+	Base string
+}
+
+// Backup writes a consistent copy of the whole store, every table with
+// its indexes and metadata, to dir while the DB stays online. dir must
+// not exist. Open the result with Open or Restore.
+func (db *DB) Backup(ctx context.Context, dir string, opts ...BackupOptions) (err error) {
+	var o BackupOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("kvdb: backup dir %s already exists", dir)
+	}
+	if o.Base != "" {
+		id, err := os.ReadFile(filepath.Join(o.Base, backupIDFile))
+		if err != nil {
+			return fmt.Errorf("kvdb: read base backup: %w", err)
+		}
+		if strings.TrimSpace(string(id)) != hex.EncodeToString(db.id) {
+			return fmt.Errorf("kvdb: base backup %s was taken from another store", o.Base)
+		}
+	}
+	if err := db.acquire(); err != nil {
+		return err
+	}
+	defer db.release()
+	db.bmu.Lock()
+	defer db.bmu.Unlock()
+
+	staging := db.fs.PathJoin(db.dir, backupStaging)
+	if err := db.fs.RemoveAll(staging); err != nil {
+		return err
+	}
+	defer db.fs.RemoveAll(staging)
+	if err := db.pdb.Checkpoint(staging, pebble.WithFlushedWAL()); err != nil {
+		return err
+	}
+	names, err := db.fs.List(staging)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src, dst := db.fs.PathJoin(staging, name), filepath.Join(dir, name)
+		if o.Base != "" && strings.HasSuffix(name, ".sst") && sameSize(db.fs, src, filepath.Join(o.Base, name)) {
+			if os.Link(filepath.Join(o.Base, name), dst) == nil {
+				continue
+			}
+		}
+		if err := linkOrCopy(db.fs, src, dst); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, backupIDFile), []byte(hex.EncodeToString(db.id)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Restore opens a DB from a backup written by Backup. The backup is
+// copied, not modified: with o.Mem the data is loaded into memory,
+// otherwise into o.Dir, which must not exist or be empty. The restored
+// DB gets a new identity, so backups of it cannot use backups of the
+// original as Base.
+func Restore(backup string, o Options) (*DB, error) {
+	// 先只读打开一次, 确认backup是完整的存储
+	check, err := pebble.Open(backup, &pebble.Options{ReadOnly: true, ErrorIfNotExists: true})
+	if err != nil {
+		return nil, fmt.Errorf("kvdb: restore %s: %w", backup, err)
+	}
+	if err := check.Close(); err != nil {
+		return nil, err
+	}
+	fs, dir := vfs.Default, o.Dir
+	if o.Mem {
+		fs, dir = vfs.NewMem(), ""
+	} else if names, err := os.ReadDir(dir); err == nil && len(names) > 0 {
+		return nil, fmt.Errorf("kvdb: restore target %s is not empty", dir)
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	names, err := os.ReadDir(backup)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range names {
+		if e.IsDir() || e.Name() == backupIDFile {
+			continue
+		}
+		if err := copyFile(vfs.Default, filepath.Join(backup, e.Name()), fs, fs.PathJoin(dir, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	db, err := open(o, fs)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.resetID(); err != nil {
+		db.Close(context.Background())
+		return nil, err
+	}
+	return db, nil
+}
+
+// sameSize 两个sst文件名相同且大小相同时视为同一个文件
+func sameSize(fs vfs.FS, src, base string) bool {
+	a, err := fs.Stat(src)
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(base)
+	return err == nil && a.Size() == b.Size()
+}
+
+// linkOrCopy 把fs中的src放到磁盘上的dst: 同在磁盘时先尝试硬链接
+func linkOrCopy(fs vfs.FS, src, dst string) error {
+	if fs == vfs.Default && strings.HasSuffix(src, ".sst") && os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(fs, src, vfs.Default, dst)
+}
+
+func copyFile(srcFS vfs.FS, src string, dstFS vfs.FS, dst string) error {
+	in, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dstFS.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return errors.Join(out.Sync(), out.Close())
+}
+
+func syncDir(dir string) error {
+	d, err := vfs.Default.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// 快照是整个存储的逻辑导出, 可以写入任何io.Writer(管道, tar, 对象存储):
+//
+//	"KVDBSNP1" { uvarint(len(key)) key uvarint(len(value)) value } uvarint(0) crc32c
+//
+// key不会为空, 长度0表示结束; crc32c是之前所有字节的校验和(大端).
+var snapshotMagic = []byte("KVDBSNP1")
+
+const snapshotBatch = 4 << 20 // LoadSnapshot每个batch的大小
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Snapshot streams a consistent copy of the whole store to w. Writes
+// continue while the snapshot is taken; they are not included.
+func (db *DB) Snapshot(ctx context.Context, w io.Writer) error {
+	if err := db.acquire(); err != nil {
+		return err
+	}
+	defer db.release()
+	snap := db.pdb.NewSnapshot()
+	defer snap.Close()
+	iter, err := snap.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	crc := crc32.New(castagnoli)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	bw.Write(snapshotMagic)
+	var n int
+	for iter.First(); iter.Valid(); iter.Next() {
+		if n++; n%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		bw.Write(binary.AppendUvarint(nil, uint64(len(iter.Key()))))
+		bw.Write(iter.Key())
+		bw.Write(binary.AppendUvarint(nil, uint64(len(iter.Value()))))
+		if _, err := bw.Write(iter.Value()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	bw.WriteByte(0)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// LoadSnapshot opens a DB described by o and fills it from a snapshot
+// written by Snapshot. The store must be empty. If the stream is
+// truncated or fails its checksum, LoadSnapshot returns an error and the
+// data already loaded into o.Dir should be discarded.
+func LoadSnapshot(r io.Reader, o Options) (*DB, error) {
+	db, err := Open(o)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.loadSnapshot(r); err != nil {
+		db.Close(context.Background())
+		return nil, fmt.Errorf("kvdb: load snapshot: %w", err)
+	}
+	return db, nil
+}
+
+func (db *DB) loadSnapshot(r io.Reader) error {
+	if len(db.tables) > 0 {
+		return errors.New("store is not empty")
+	}
+	br := bufio.NewReader(r)
+	tr := &crcReader{r: br, crc: crc32.New(castagnoli)}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(tr, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return errors.New("not a kvdb snapshot")
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(tr)
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: length %d", ErrCorrupt, n)
+		}
+		// 不按长度预先分配, 损坏的长度不会导致分配大量内存
+		bs, err := io.ReadAll(io.LimitReader(tr, int64(n)))
+		if err == nil && uint64(len(bs)) < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return bs, err
+	}
+	b := db.pdb.NewBatch()
+	defer func() { b.Close() }()
+	for {
+		key, err := readBytes()
+		if err != nil {
+			return fmt.Errorf("%w: %v", io.ErrUnexpectedEOF, err)
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readBytes()
+		if err != nil {
+			return fmt.Errorf("%w: %v", io.ErrUnexpectedEOF, err)
+		}
+		if err := b.Set(key, value, nil); err != nil {
+			return err
+		}
+		if b.Len() >= snapshotBatch {
+			if err := b.Commit(pebble.NoSync); err != nil {
+				return err
+			}
+			b.Close()
+			b = db.pdb.NewBatch()
+		}
+	}
+	sum := tr.crc.Sum32()
+	tail := make([]byte, 4)
+	if _, err := io.ReadFull(br, tail); err != nil {
+		return fmt.Errorf("%w: missing checksum", io.ErrUnexpectedEOF)
+	}
+	if binary.BigEndian.Uint32(tail) != sum {
+		return fmt.Errorf("%w: snapshot checksum mismatch", ErrCorrupt)
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	return errors.Join(db.loadCatalog(), db.resetID())
+}
+
+// crcReader 只对已读出的字节计算校验和
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.Write([]byte{b})
+	}
+	return b, err
+}
@@ -0,0 +1,340 @@
+package kvdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// 每个key的前缀: 4字节表id + 1字节命名空间
+const (
+	nsMain       byte = 'm' //主记录
+	nsIndex      byte = 'i' //索引
+	nsMeta       byte = 's' //表的元数据, 如自增序列
+	nsExpire     byte = 'x' //过期索引: 过期时间 + id
+	nsQuarantine byte = 'q' //无法解码的记录: id -> 原始值
+	nsChange     byte = 'c' //变更日志: 序号 -> 变更
+	nsCatalog    byte = 't' //表名 -> 表id, 只在表0下使用
+)
+
+const _MetaTable uint32 = 0 // 保留给DB自身的元数据
+
+// Options configures Open. Dir holds a single store shared by all
+// tables. Earlier versions kept a pair of stores per table under
+// Dir/<name>/mdb and Dir/<name>/idb; the records in mdb are imported the
+// first time the table is opened and its indexes are rebuilt. The old
+// directories are left untouched and can be removed afterwards.
+type Options struct {
+	Dir string // 数据目录, Mem为true时忽略
+	Mem bool   // 纯内存数据库, 关闭后数据丢失
+}
+
+// DB is a single pebble store hosting any number of tables. Every table
+// gets its own id and keeps its rows and index entries under that id, so
+// writes to several tables can be committed in one batch.
+type DB struct {
+	pdb    *pebble.DB
+	fs     vfs.FS       // 存储所在的文件系统, Mem时为内存文件系统
+	dir    string       // 存储在fs中的目录
+	id     []byte       // 存储的唯一标识, 增量备份用它确认Base来自同一个存储
+	bmu    sync.Mutex   // 串行化备份
+	mu     sync.Mutex   // 串行化写事务
+	owner  atomic.Int64 // 持有mu的goroutine, 用于发现嵌套事务
+	omu    sync.Mutex   // 串行化打开表, 同名的表只打开一次
+	tmu    sync.Mutex   // 保护tables和opened
+	tables map[string]uint32
+	opened map[string]interface{ close() error } // 打开中的表, 表名 -> *TableMem[T]
+	closed atomic.Bool
+	opmu   sync.Mutex     // 保护ops.Add与closed的先后顺序
+	ops    sync.WaitGroup // 进行中的读写
+	done   chan struct{}  // 存储关闭后关闭
+	err    error          // 关闭存储的结果, done关闭后可读
+}
+
+// Open opens the store described by o. Independent DBs can be open at
+// the same time; each owns its own store and is released by Close.
+func Open(o Options) (*DB, error) {
+	if o.Mem {
+		// 纯内存数据库（数据仅存于内存）
+		return open(o, vfs.NewMem())
+	}
+	return open(o, vfs.Default)
+}
+
+// open 在文件系统fs上打开存储, Restore用它打开预先写好文件的内存文件系统
+func open(o Options, fs vfs.FS) (*DB, error) {
+	dir := is(o.Mem, "", o.Dir)
+	pdb, err := pebble.Open(dir, &pebble.Options{
+		FS:           fs,
+		BytesPerSync: 1 << 20, // 1MB同步一次，提升写入性能
+	})
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		pdb:    pdb,
+		fs:     fs,
+		dir:    dir,
+		tables: make(map[string]uint32),
+		opened: make(map[string]interface{ close() error }),
+		done:   make(chan struct{}),
+	}
+	if err := errors.Join(db.loadCatalog(), db.loadID()); err != nil {
+		pdb.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+var defaultDB struct {
+	sync.Mutex
+	db *DB
+}
+
+// getDefaultDB 返回按memOptions打开的默认DB, NewTableMem使用
+func getDefaultDB() (*DB, error) {
+	defaultDB.Lock()
+	defer defaultDB.Unlock()
+	if defaultDB.db == nil {
+		db, err := Open(memOptions)
+		if err != nil {
+			return nil, err
+		}
+		defaultDB.db = db
+	}
+	return defaultDB.db, nil
+}
+
+// Close stops accepting new operations, waits for in-flight reads and
+// writes to finish, flushes memtables and closes every table opened on
+// db and the store itself. If ctx ends first Close returns ctx.Err() and
+// the store is closed in the background once the operations finish.
+// Calling Close again waits for the same outcome.
+func (db *DB) Close(ctx context.Context) error {
+	db.opmu.Lock()
+	first := db.closed.CompareAndSwap(false, true)
+	db.opmu.Unlock()
+	if first {
+		go func() {
+			db.ops.Wait()
+			db.err = db.shutdown()
+			close(db.done)
+		}()
+	}
+	select {
+	case <-db.done:
+		return db.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *DB) shutdown() error {
+	db.tmu.Lock()
+	opened := db.opened
+	db.opened = nil
+	db.tmu.Unlock()
+	var errs []error
+	for _, t := range opened {
+		errs = append(errs, t.close())
+	}
+	errs = append(errs, db.pdb.Flush(), db.pdb.Close())
+	return errors.Join(errs...)
+}
+
+// acquire 登记一个进行中的操作, db已关闭时返回ErrClosed; 成功后必须调用release
+func (db *DB) acquire() error {
+	db.opmu.Lock()
+	defer db.opmu.Unlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	db.ops.Add(1)
+	return nil
+}
+
+func (db *DB) release() {
+	db.ops.Done()
+}
+
+// register 记录在db上打开的表, db关闭时一并关闭
+func (db *DB) register(name string, t interface{ close() error }) error {
+	db.tmu.Lock()
+	defer db.tmu.Unlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	db.opened[name] = t
+	return nil
+}
+
+// unregister 表单独关闭后移除, 之后可以重新打开
+func (db *DB) unregister(name string, t interface{ close() error }) {
+	db.tmu.Lock()
+	defer db.tmu.Unlock()
+	if db.opened[name] == t {
+		delete(db.opened, name)
+	}
+}
+
+// lookup 返回已打开的同名表
+func (db *DB) lookup(name string) (interface{ close() error }, bool) {
+	db.tmu.Lock()
+	defer db.tmu.Unlock()
+	t, ok := db.opened[name]
+	return t, ok
+}
+
+func (db *DB) loadCatalog() error {
+	prefix := keyPrefix(_MetaTable, nsCatalog)
+	iter, err := db.pdb.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	if err != nil {
+		return err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		name := string(iter.Key()[len(prefix):])
+		db.tables[name] = binary.BigEndian.Uint32(iter.Value())
+	}
+	return errors.Join(iter.Error(), iter.Close())
+}
+
+func (db *DB) idKey() []byte {
+	return append(keyPrefix(_MetaTable, nsMeta), "id"...)
+}
+
+// loadID 读取存储的唯一标识, 没有时生成一个
+func (db *DB) loadID() error {
+	bs, closer, err := db.pdb.Get(db.idKey())
+	if errors.Is(err, pebble.ErrNotFound) {
+		return db.resetID()
+	} else if err != nil {
+		return err
+	}
+	defer closer.Close()
+	db.id = bytes.Clone(bs)
+	return nil
+}
+
+// resetID 生成新的唯一标识. 从备份恢复的存储与原存储此后各自写入, 需要不同的标识
+func (db *DB) resetID() error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	if err := db.pdb.Set(db.idKey(), id, pebble.Sync); err != nil {
+		return err
+	}
+	db.id = id
+	return nil
+}
+
+// tableID 返回表名对应的id, 不存在时分配一个新的并写入目录
+func (db *DB) tableID(name string) (uint32, error) {
+	db.tmu.Lock()
+	defer db.tmu.Unlock()
+	if id, ok := db.tables[name]; ok {
+		return id, nil
+	}
+	var id uint32 = _MetaTable + 1
+	for _, v := range db.tables {
+		if v >= id {
+			id = v + 1
+		}
+	}
+	value := binary.BigEndian.AppendUint32(nil, id)
+	if err := db.pdb.Set(append(keyPrefix(_MetaTable, nsCatalog), name...), value, pebble.Sync); err != nil {
+		return 0, err
+	}
+	db.tables[name] = id
+	return id, nil
+}
+
+// Batch stages writes across any number of tables of the same DB and
+// commits them atomically.
+type Batch struct {
+	db       *DB
+	b        *pebble.Batch
+	onCommit []func()
+}
+
+// Txn runs fn with a batch that is committed when fn returns nil and
+// discarded otherwise. Use Bind to get a table's Tx on the batch.
+// Transactions do not nest: a write through a table's own methods (not
+// its Tx) from inside fn or a hook fails with ErrNestedTxn.
+func (db *DB) Txn(fn func(b *Batch) error) error {
+	if err := db.acquire(); err != nil {
+		return err
+	}
+	defer db.release()
+	g := goid()
+	if db.owner.Load() == g {
+		return ErrNestedTxn
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.owner.Store(g)
+	defer db.owner.Store(0)
+	b := &Batch{db: db, b: db.pdb.NewIndexedBatch()}
+	defer b.b.Close()
+	if err := fn(b); err != nil {
+		return err
+	}
+	if err := b.b.Commit(pebble.Sync); err != nil {
+		return err
+	}
+	for _, f := range b.onCommit {
+		f()
+	}
+	return nil
+}
+
+// goid 当前goroutine的id. 写事务的锁不可重入, 持有锁的goroutine再次加锁
+// 会永远等待, 记下持有者以便返回ErrNestedTxn
+func goid() int64 {
+	var buf [32]byte
+	s := buf[len("goroutine "):runtime.Stack(buf[:], false)]
+	id, _ := strconv.ParseInt(string(s[:bytes.IndexByte(s, ' ')]), 10, 64)
+	return id
+}
+
+// Bind returns table's view of a DB batch. The table must belong to the
+// batch's DB.
+func Bind[T Entity](b *Batch, table Table[T]) (Tx[T], error) {
+	t, ok := table.(*TableMem[T])
+	if !ok || t.db != b.db {
+		return nil, newError("bind", table.Name(), "", errors.New("table does not belong to this db"))
+	}
+	if t.closed.Load() {
+		return nil, newError("bind", t.name, "", ErrClosed)
+	}
+	return t.bind(b), nil
+}
+
+func keyPrefix(table uint32, ns byte) []byte {
+	prefix := binary.BigEndian.AppendUint32(make([]byte, 0, 5), table)
+	return append(prefix, ns)
+}
+
+// prefixEnd 返回以prefix开头的所有key的上界(不含)
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
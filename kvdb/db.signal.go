@@ -0,0 +1,39 @@
+package kvdb
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// ExitOnSignal is an opt-in helper for programs that want kvdb to own
+// shutdown: on SIGINT/SIGTERM (or the given sigs) it closes db, waiting
+// for in-flight operations, and exits the process with status 0, or 1 if
+// closing failed. The returned stop function removes the handler.
+func ExitOnSignal(db *DB, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	quit := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		select {
+		case <-ch:
+			if err := db.Close(context.Background()); err != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case <-quit:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(quit)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// 索引key: 索引名 0x00 编码后的字段值 记录id
+//
+// 字段值按类型编码成保持顺序的字节串, 使pebble的字节序等于值的自然顺序:
+//   - 有符号整数/time.Time: 8字节大端, 翻转符号位
+//   - 无符号整数: 8字节大端
+//   - 浮点数: IEEE754位, 正数翻转符号位, 负数按位取反
+//   - bool: 1字节
+//   - 字符串: 0x00转义为0x00 0xff, 以0x00 0x01结尾
+//
+// 所有编码都是自定界的, 因此后面可以直接拼接id或下一个字段.
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func appendOrderedInt(b []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(v)^(1<<63))
+}
+
+func appendOrderedFloat(b []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits ^= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(b, bits)
+}
+
+func appendOrderedString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0x00 {
+			b = append(b, 0x00, 0xff)
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return append(b, 0x00, 0x01)
+}
+
+// appendOrdered 追加v的保序编码, v必须是索引支持的类型
+func appendOrdered(b []byte, v reflect.Value) []byte {
+	if v.Type() == timeType {
+		return appendOrderedInt(b, v.Interface().(time.Time).UnixNano())
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendOrderedInt(b, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.BigEndian.AppendUint64(b, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return appendOrderedFloat(b, v.Float())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case reflect.String:
+		return appendOrderedString(b, v.String())
+	default:
+		return appendOrderedString(b, fmt.Sprintf("%v", v.Interface()))
+	}
+}
+
+// convertValue 把查询或更新传入的值转换成字段类型typ, 数值之间可互转,
+// 字符串可解析为数值/bool/time(RFC3339)
+func convertValue(v any, typ reflect.Type) (reflect.Value, error) {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	rv := getRefValueElem(v)
+	if !rv.IsValid() {
+		return rv, fmt.Errorf("kvdb: cannot use nil as %s", typ)
+	}
+	if rv.Type() == typ {
+		return rv, nil
+	}
+	isNum := func(k reflect.Kind) bool {
+		return k >= reflect.Int && k <= reflect.Float64
+	}
+	switch {
+	case isNum(rv.Kind()) && isNum(typ.Kind()),
+		rv.Kind() == reflect.String && typ.Kind() == reflect.String,
+		rv.Kind() == reflect.Bool && typ.Kind() == reflect.Bool:
+		return rv.Convert(typ), nil
+	case rv.Kind() == reflect.String:
+		s := rv.String()
+		out := reflect.New(typ).Elem()
+		var err error
+		switch {
+		case typ == timeType:
+			var tm time.Time
+			if tm, err = time.Parse(time.RFC3339Nano, s); err == nil {
+				out.Set(reflect.ValueOf(tm))
+			}
+		case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Int64:
+			var n int64
+			if n, err = strconv.ParseInt(s, 10, 64); err == nil {
+				out.SetInt(n)
+			}
+		case typ.Kind() >= reflect.Uint && typ.Kind() <= reflect.Uintptr:
+			var n uint64
+			if n, err = strconv.ParseUint(s, 10, 64); err == nil {
+				out.SetUint(n)
+			}
+		case typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64:
+			var f float64
+			if f, err = strconv.ParseFloat(s, 64); err == nil {
+				out.SetFloat(f)
+			}
+		case typ.Kind() == reflect.Bool:
+			var ok bool
+			if ok, err = strconv.ParseBool(s); err == nil {
+				out.SetBool(ok)
+			}
+		default:
+			err = fmt.Errorf("unsupported type")
+		}
+		if err != nil {
+			return out, fmt.Errorf("kvdb: cannot use %q as %s: %v", s, typ, err)
+		}
+		return out, nil
+	case rv.Type().ConvertibleTo(typ) && rv.Kind() == typ.Kind():
+		return rv.Convert(typ), nil
+	}
+	return rv, fmt.Errorf("kvdb: cannot use %T as %s", v, typ)
+}
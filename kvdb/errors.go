@@ -0,0 +1,52 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound      = errors.New("kvdb: not found")            //记录不存在
+	ErrCorrupt       = errors.New("kvdb: corrupt record")       //记录无法解码
+	ErrClosed        = errors.New("kvdb: closed")               //表或DB已关闭
+	ErrNoIndex       = errors.New("kvdb: no such index")        //索引不存在
+	ErrIndexBuilding = errors.New("kvdb: index is being built") //索引正在后台回填, 暂不能查询
+	ErrNoKey         = errors.New("kvdb: no primaryKey")        //实体没有primaryKey字段
+
+	ErrUniqueViolation = errors.New("kvdb: unique index violation") //唯一索引的值已被其他记录使用
+	ErrConflict        = errors.New("kvdb: version conflict")       //记录已被其他写入修改
+	ErrCompacted       = errors.New("kvdb: change log compacted")   //需要的变更日志已被删除
+	ErrInvalid         = errors.New("kvdb: invalid record")         //Validate拒绝了写入
+	ErrNestedTxn       = errors.New("kvdb: nested transaction")     //在事务内(如钩子中)开始了新的事务
+)
+
+// Error describes a failed table operation. Err is either one of the
+// sentinel errors above or the error reported by the storage backend.
+type Error struct {
+	Op    string
+	Table string
+	Key   string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("kvdb: %s %s: %v", e.Op, e.Table, e.Err)
+	}
+	return fmt.Sprintf("kvdb: %s %s[%s]: %v", e.Op, e.Table, e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(op string, table string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Op: op, Table: table, Key: key, Err: err}
+}
@@ -0,0 +1,102 @@
+package kvdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// IDKind selects how Save generates the primary key of a record whose
+// primaryKey field is empty.
+type IDKind int
+
+const (
+	IDULID     IDKind = iota // 26位ULID, 按时间有序(默认)
+	IDUUIDv7                 // RFC 9562 UUIDv7, 按时间有序
+	IDSequence               // 每个表独立的自增序列, 从1开始
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulidState struct {
+	sync.Mutex
+	ms   uint64
+	rand [10]byte
+}
+
+// newULID 同一毫秒内递增随机部分, 保证同一进程生成的id严格有序
+func newULID() string {
+	ulidState.Lock()
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= ulidState.ms {
+		ms = ulidState.ms
+		for i := len(ulidState.rand) - 1; i >= 0; i-- {
+			ulidState.rand[i]++
+			if ulidState.rand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		ulidState.ms = ms
+		rand.Read(ulidState.rand[:])
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	copy(b[6:], ulidState.rand[:])
+	ulidState.Unlock()
+
+	// 128位按5位一组编码, 首字符只用3位
+	out := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+var uuidState struct {
+	sync.Mutex
+	ms  uint64
+	seq uint16 // 12位rand_a, 同一毫秒内递增
+}
+
+func newUUIDv7() string {
+	var b [16]byte
+	rand.Read(b[:])
+	uuidState.Lock()
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= uuidState.ms {
+		ms = uuidState.ms
+		uuidState.seq++
+		if uuidState.seq > 0x0fff {
+			ms++
+			uuidState.ms = ms
+			uuidState.seq = 0
+		}
+	} else {
+		uuidState.ms = ms
+		uuidState.seq = binary.BigEndian.Uint16(b[6:8]) & 0x07ff
+	}
+	seq := uuidState.seq
+	uuidState.Unlock()
+
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	binary.BigEndian.PutUint16(b[6:8], 0x7000|seq)
+	b[8] = b[8]&0x3f | 0x80
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
+}
@@ -1,5 +1,7 @@
 package kvdb
 
+import "context"
+
 //"github.com/redis/go-redis/v9"
 
 type RedisOptions struct {
@@ -30,15 +32,31 @@ type RedisOptions struct {
 		//	ctx = context.Background()
 	}
 */
-type MemOptions struct {
-	Dir string
-	Mem bool
-}
+// MemOptions is the former name of Options.
+//
+// Deprecated: use Options with Open.
+type MemOptions = Options
 
 var memOptions MemOptions = MemOptions{
 	Mem: true,
 }
 
+// InitMem sets the options of the default DB used by NewTableMem. Calling
+// it again with the same options keeps the open store. Otherwise the
+// previous default DB is closed, together with the tables opened on it,
+// and tables opened afterwards get a freshly opened store.
+//
+// Deprecated: use Open and NewTable, which do not share global state.
 func InitMem(options MemOptions) {
+	defaultDB.Lock()
+	defer defaultDB.Unlock()
+	if options == memOptions && defaultDB.db != nil {
+		return
+	}
 	memOptions = options
+	if defaultDB.db != nil {
+		// 关闭旧存储, 否则泄漏, 且同一Dir再次打开时pebble的文件锁仍被持有
+		defaultDB.db.Close(context.Background())
+		defaultDB.db = nil
+	}
 }
@@ -1,17 +1,57 @@
 package kvdb
 
 import (
+	"context"
 	"fmt"
+	"iter"
 	"reflect"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type IndexInfo struct {
-	Name  string
-	Field string
-	Type  string
+	Name   string
+	Field  string   // 第一个字段
+	Fields []string // 所有字段, 组合索引按声明的位置排序
+	Type   string   // 第一个字段的类型
+	Unique bool     // 唯一索引, 一个值最多对应一条记录
+	typs   []reflect.Type
+	blind  []byte // 不为nil时字段值以HMAC代替, 只支持等值查询, 见TableOptions.BlindIndexes
 }
+
+// IndexKey queries a composite index by its leading fields. It can be
+// passed as the value of SearchByIdx and as lo/hi of RangeByIdx; any
+// other value is treated as IndexKey{value}.
+type IndexKey []any
+
+// RangeOptions controls RangeByIdx. A nil lo or hi leaves that end of
+// the range open.
+type RangeOptions struct {
+	LoExclusive bool // 不包含下界
+	HiExclusive bool // 不包含上界
+	Desc        bool // 降序
+	Limit       int  // 最多返回条数, <=0不限制
+}
+
+// TableOptions configures a table opened by NewTable.
+type TableOptions struct {
+	IDKind        IDKind        // Save在primaryKey字段为空时生成id的方式
+	SweepInterval time.Duration // 后台清理过期记录的间隔, 0为默认1分钟, <0不清理
+
+	OnIndexProgress func(p IndexProgress) // 新增索引后台回填的进度, 每批记录回调一次
+	SchemaVersion   uint32                // T的结构版本, 写入记录时保存; 读取旧版本记录时按Migrate注册的函数升级
+	Codec           Codec                 // 写入记录使用的编码, nil为MsgpackCodec; 读取时按记录头部选择
+	Compression     Compression           // 写入记录使用的压缩算法; 读取时按记录头部选择
+	Keys            KeyProvider           // 不为nil时用AES-GCM加密写入的记录; 读取时按记录头部的密钥id解密
+	BlindIndexes    bool                  // 索引key中的字段值以HMAC代替(需要Keys), 索引只支持等值查询
+	ChangeLog       int                   // 保留的变更日志条数, >0时开启变更日志, Watch依赖它
+	CompressMin     int                   // 只压缩不小于该长度的payload, 0为默认512字节
+	ZstdDicts       [][]byte              // zstd训练字典, 第一个用于写入, 其余只用于读取旧记录
+}
+
 type Entity interface {
 }
 type Table[T Entity] interface {
@@ -22,53 +62,190 @@ type Table[T Entity] interface {
 	//idb    *redis.Client
 	//Indexs() map[string]IndexInfo
 	Get(id string) (v T, ok bool)                                                          //获取,根据id
+	GetWithVersion(id string) (v T, version uint64, ok bool)                               //获取记录和版本号
 	Gets(ids ...string) (list []T)                                                         //获取列表,多个id
-	Insert(id string, v *T) error                                                          //插入
+	Insert(id string, v *T) error                                                          //插入, id已存在时覆盖
+	Upsert(id string, v *T) error                                                          //插入或覆盖, 同Insert
+	InsertIfAbsent(id string, v *T) (inserted bool, err error)                             //id不存在时插入
+	InsertWithTTL(id string, v *T, ttl time.Duration) error                                //插入, ttl后过期
+	Save(v *T) error                                                                       //按primaryKey字段插入或覆盖, 字段为空时生成id并回写
 	Update(id string, v H) error                                                           //更新
+	UpdateIf(id string, version uint64, v H) error                                         //版本号等于version时更新, 否则返回ErrConflict
+	CompareAndSwap(id string, old, new *T) error                                           //当前值等于old时替换为new, 否则返回ErrConflict; old为nil时仅在不存在时插入
+	Modify(id string, fn func(v *T) error) error                                           //读取记录, 由fn修改后写回, 按新旧值维护索引
 	Delete(ids ...string)                                                                  //删除
 	Search(id string, filter func(v T) bool, start_end ...int) (list []T)                  //搜索
 	SearchByIdx(idx string, value any, filter func(v T) bool, start_end ...int) (list []T) //搜索
+	RangeByIdx(idx string, lo, hi any, opts ...RangeOptions) (list []T)                    //按索引值范围查询
+	SearchPage(id string, filter func(v T) bool, cursor Cursor, limit int) Page[T]         //分页搜索
+	SearchByIdxPage(idx string, value any, filter func(v T) bool, cursor Cursor, limit int) Page[T]
+	GetByUnique(idx string, value any) (v T, ok bool) //按唯一索引获取
 	Scan(handle func(v T) bool)
-	Close() //扫描
-	init()  //初始化db表
+	All() iter.Seq2[string, T]                                     //遍历所有记录(id, 值)
+	Prefix(p string) iter.Seq2[string, T]                          //遍历id以p开头的记录
+	ByIndex(idx string, value any) iter.Seq2[string, T]            //按索引值遍历
+	Watch(ctx context.Context, filter WatchFilter) <-chan Event[T] //订阅提交的变更, ctx结束时关闭
+	VerifyIndexes() (IndexReport, error)                           //检查索引和记录是否一致
+	RebuildIndex(name string) error                                //根据记录重建索引name
+	RebuildAllIndexes() error                                      //根据记录重建所有索引
+	Rekey() (RewriteResult, error)                                 //用当前密钥重新加密其他密钥加密或未加密的记录
+	Hook(h Hooks[T])                                               //注册写入钩子
+	Migrate(from uint32, fn MigrateFunc)                           //注册把结构版本from的记录升级到from+1的函数
+	MigrateAll() (RewriteResult, error)                            //把所有旧版本记录升级并写回
+	Quarantine() ([]QuarantineEntry, error)                        //列出被隔离的无法解码的记录
+	InspectQuarantine(id string) (map[string]any, error)           //把被隔离的记录解码为通用map
+	RestoreQuarantine(id string, v *T) error                       //恢复被隔离的记录, v为nil时按原始值恢复
+	Close()                                                        //扫描
+	Ctx() TableCtx[T]                                              //返回带context和错误返回的版本
+	Txn(fn func(tx Tx[T]) error) error                             //事务,fn返回错误时回滚
+	init()                                                         //初始化db表
+}
+
+// TableCtx is the context-aware variant of Table. Every method reports
+// failures: ErrNotFound, ErrCorrupt, ErrClosed and ErrConflict can be tested with
+// errors.Is, anything else is an error from the storage backend.
+type TableCtx[T Entity] interface {
+	Name() string                                                                                                          //表名
+	Get(ctx context.Context, id string) (v T, err error)                                                                   //获取,根据id
+	GetWithVersion(ctx context.Context, id string) (v T, version uint64, err error)                                        //获取记录和版本号
+	Gets(ctx context.Context, ids ...string) (list []T, err error)                                                         //获取列表,多个id,不存在的id被忽略
+	Insert(ctx context.Context, id string, v *T) error                                                                     //插入, id已存在时覆盖
+	Upsert(ctx context.Context, id string, v *T) error                                                                     //插入或覆盖, 同Insert
+	InsertIfAbsent(ctx context.Context, id string, v *T) (inserted bool, err error)                                        //id不存在时插入
+	InsertWithTTL(ctx context.Context, id string, v *T, ttl time.Duration) error                                           //插入, ttl后过期
+	Save(ctx context.Context, v *T) error                                                                                  //按primaryKey字段插入或覆盖, 字段为空时生成id并回写
+	Update(ctx context.Context, id string, v H) error                                                                      //更新
+	UpdateIf(ctx context.Context, id string, version uint64, v H) error                                                    //版本号等于version时更新, 否则返回ErrConflict
+	CompareAndSwap(ctx context.Context, id string, old, new *T) error                                                      //当前值等于old时替换为new, 否则返回ErrConflict; old为nil时仅在不存在时插入
+	Modify(ctx context.Context, id string, fn func(v *T) error) error                                                      //读取记录, 由fn修改后写回, 按新旧值维护索引
+	Delete(ctx context.Context, ids ...string) error                                                                       //删除
+	Search(ctx context.Context, id string, filter func(v T) bool, start_end ...int) (list []T, err error)                  //搜索
+	SearchByIdx(ctx context.Context, idx string, value any, filter func(v T) bool, start_end ...int) (list []T, err error) //搜索
+	RangeByIdx(ctx context.Context, idx string, lo, hi any, opts ...RangeOptions) (list []T, err error)                    //按索引值范围查询
+	SearchPage(ctx context.Context, id string, filter func(v T) bool, cursor Cursor, limit int) (Page[T], error)           //分页搜索
+	SearchByIdxPage(ctx context.Context, idx string, value any, filter func(v T) bool, cursor Cursor, limit int) (Page[T], error)
+	GetByUnique(ctx context.Context, idx string, value any) (v T, err error)                 //按唯一索引获取
+	Txn(ctx context.Context, fn func(tx Tx[T]) error) error                                  //事务,fn返回错误时回滚
+	All(ctx context.Context) (iter.Seq2[string, T], func() error)                            //遍历所有记录, 循环结束后调用返回的函数获取错误
+	Prefix(ctx context.Context, p string) (iter.Seq2[string, T], func() error)               //遍历id以p开头的记录
+	ByIndex(ctx context.Context, idx string, value any) (iter.Seq2[string, T], func() error) //按索引值遍历
+	Sweep(ctx context.Context) (n int, err error)                                            //立即删除已过期的记录
+	Watch(ctx context.Context, filter WatchFilter) <-chan Event[T]                           //订阅提交的变更, ctx结束时关闭
+	VerifyIndexes(ctx context.Context) (IndexReport, error)                                  //检查索引和记录是否一致
+	RebuildIndex(ctx context.Context, name string) error                                     //根据记录重建索引name
+	RebuildAllIndexes(ctx context.Context) error                                             //根据记录重建所有索引
+	Rekey(ctx context.Context) (RewriteResult, error)                                        //用当前密钥重新加密其他密钥加密或未加密的记录
+	WaitIndexes(ctx context.Context) error                                                   //等待新增索引回填完成
+	Hook(h Hooks[T])                                                                         //注册写入钩子
+	Migrate(from uint32, fn MigrateFunc)                                                     //注册把结构版本from的记录升级到from+1的函数
+	MigrateAll(ctx context.Context) (RewriteResult, error)                                   //把所有旧版本记录升级并写回
+	Quarantine(ctx context.Context) ([]QuarantineEntry, error)                               //列出被隔离的无法解码的记录
+	InspectQuarantine(ctx context.Context, id string) (map[string]any, error)                //把被隔离的记录解码为通用map
+	RestoreQuarantine(ctx context.Context, id string, v *T) error                            //恢复被隔离的记录, v为nil时按原始值恢复
+	Scan(ctx context.Context, handle func(v T) bool) error                                   //扫描
+	Close() error
+}
+
+// NewTable opens table name on db, creating it on first use. The table
+// is closed together with db. opts is optional. Opening a name that is
+// already open returns the open table if T matches, ignoring opts, and
+// an error otherwise; after Close the name can be opened again.
+func NewTable[T Entity](db *DB, name string, opts ...TableOptions) (Table[T], error) {
+	var o TableOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	table, err := newTableMem[T](db, name, o)
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// taggedField 返回kvdb标签中带有选项opt(按;分隔)的第一个字段名
+func taggedField[T any](opt string) string {
+	modeType := getRefTypeElem(new(T))
+	if modeType.Kind() != reflect.Struct {
+		return ""
+	}
+	for i := range modeType.NumField() {
+		field := modeType.Field(i)
+		for _, o := range strings.Split(field.Tag.Get("kvdb"), ";") {
+			if strings.TrimSpace(o) == opt {
+				return field.Name
+			}
+		}
+	}
+	return ""
 }
 
-func NewTable[T Entity](name string) Table[T] {
-	table := NewTableMem[T](name)
-	return table
+// primaryKeyField 返回带kvdb:"primaryKey"标签的字段名
+func primaryKeyField[T any]() string {
+	modeType := getRefTypeElem(new(T))
+	if modeType.Kind() != reflect.Struct {
+		return ""
+	}
+	for i := range modeType.NumField() {
+		field := modeType.Field(i)
+		if strings.Contains(field.Tag.Get("kvdb"), "primaryKey") {
+			return field.Name
+		}
+	}
+	return ""
 }
 
+// createIndexs 解析kvdb标签中的索引:
+//
+//	kvdb:"index:idx_name"          普通索引
+//	kvdb:"uniqueIndex:idx_email"   唯一索引
+//	kvdb:"index:idx_tenant_time,1" 组合索引, 同名索引的字段按位置排序
 func createIndexs[T any]() map[string]IndexInfo {
 	mapidxs := make(map[string]IndexInfo)
 	mode := new(T)
 	modeType := getRefTypeElem(mode)
-	var indexes []IndexInfo
+	type indexField struct {
+		pos   int
+		field reflect.StructField
+	}
+	var names []string
+	fields := make(map[string][]indexField)
+	unique := make(map[string]bool)
 	for i := range modeType.NumField() {
 		field := modeType.Field(i)
 		tag := field.Tag.Get("kvdb")
+		var def string
 		if strings.Contains(tag, "primaryKey") {
+		} else if strings.Contains(tag, "uniqueIndex:") {
+			def = strings.Split(tag, "uniqueIndex:")[1]
 		} else if strings.Contains(tag, "index:") {
-			indexName := strings.Split(tag, "index:")[1]
-			indexName = regexp.MustCompile(`;.*$`).ReplaceAllString(indexName, "")
-			indexInfo := IndexInfo{
-				Name:  indexName,
-				Field: field.Name,
-				Type:  field.Type.String(),
-			}
-			indexes = append(indexes, indexInfo)
-		} /* else if strings.Contains(tag, "uniqueIndex:") {
-			indexName := strings.Split(tag, "uniqueIndex:")[1]
-			indexName = regexp.MustCompile(`;.*$`).ReplaceAllString(indexName, "")
-			indexInfo := IndexInfo{
-				Name:  indexName,
-				Field: field.Name,
-				Type:  field.Type.String(),
-			}
-			indexes = append(indexes, indexInfo)
-		} */
+			def = strings.Split(tag, "index:")[1]
+		}
+		if def == "" {
+			continue
+		}
+		def = regexp.MustCompile(`;.*$`).ReplaceAllString(def, "")
+		indexName, pos, _ := strings.Cut(def, ",")
+		p, _ := strconv.Atoi(strings.TrimSpace(pos))
+		if _, ok := fields[indexName]; !ok {
+			names = append(names, indexName)
+		}
+		fields[indexName] = append(fields[indexName], indexField{pos: p, field: field})
+		unique[indexName] = unique[indexName] || strings.Contains(tag, "uniqueIndex:")
 	}
-	for _, idx := range indexes {
-		mapidxs[idx.Name] = idx
+	for _, name := range names {
+		fs := fields[name]
+		slices.SortStableFunc(fs, func(a, b indexField) int { return a.pos - b.pos })
+		idx := IndexInfo{
+			Name:   name,
+			Field:  fs[0].field.Name,
+			Type:   fs[0].field.Type.String(),
+			Unique: unique[name],
+		}
+		for _, f := range fs {
+			idx.Fields = append(idx.Fields, f.field.Name)
+			idx.typs = append(idx.typs, f.field.Type)
+		}
+		mapidxs[name] = idx
 	}
 	return mapidxs
 }
@@ -147,13 +324,87 @@ func isSameValue(v1 any, v2 reflect.Value) bool {
 	return reflect.DeepEqual(v1, v2.Interface())
 }
 
-const _Separator = string(byte(0)) // 或直接写 `"\x00"`
-func buildIndexKey(index IndexInfo, value any, args ...string) string {
-	sv := fmt.Sprintf("%v", value)
-	vs := []string{}
-	vs = append(vs, sv)
-	vs = append(vs, args...)
-	return fmt.Sprintf("%s-%s", index.Name, strings.Join(vs, _Separator))
+// prefix 索引key前缀: 索引名 0x00
+func (idx IndexInfo) prefix() []byte {
+	return append([]byte(idx.Name), 0x00)
+}
+
+// queryKey 查询值的编码: 索引名+前几个字段的值, 是所有匹配记录的key前缀
+func (idx IndexInfo) queryKey(value any) ([]byte, error) {
+	values, ok := value.(IndexKey)
+	if !ok {
+		values = IndexKey{value}
+	}
+	if len(values) > len(idx.Fields) {
+		return nil, fmt.Errorf("kvdb: index %s has %d fields, got %d values", idx.Name, len(idx.Fields), len(values))
+	}
+	if idx.blind != nil && len(values) != len(idx.Fields) {
+		return nil, fmt.Errorf("%w: blinded index %s needs all %d fields", ErrNoIndex, idx.Name, len(idx.Fields))
+	}
+	key := idx.prefix()
+	for i, v := range values {
+		rv, err := convertValue(v, idx.typs[i])
+		if err != nil {
+			return nil, err
+		}
+		key = appendOrdered(key, rv)
+	}
+	return idx.blinded(key), nil
+}
+
+// entityKey 记录在索引中的key, 任一字段为nil指针时不建索引
+func (idx IndexInfo) entityKey(entity any, id string) ([]byte, bool) {
+	key := idx.prefix()
+	for _, f := range idx.Fields {
+		value := getValue(entity, f)
+		if !value.IsValid() {
+			return nil, false
+		}
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return nil, false
+			}
+			value = value.Elem()
+		}
+		key = appendOrdered(key, value)
+	}
+	return idx.withID(idx.blinded(key), id), true
+}
+
+// patchKey 用patch中的值覆盖old的字段后在索引中的key
+func (idx IndexInfo) patchKey(old any, patch H, id string) ([]byte, bool, error) {
+	key := idx.prefix()
+	for i, f := range idx.Fields {
+		val, ok := patch[f]
+		if !ok {
+			value := getValue(old, f)
+			if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+				return nil, false, nil
+			}
+			val = value.Interface()
+		} else if val == nil && idx.typs[i].Kind() == reflect.Ptr {
+			return nil, false, nil
+		}
+		rv, err := convertValue(val, idx.typs[i])
+		if err != nil {
+			return nil, false, err
+		}
+		key = appendOrdered(key, rv)
+	}
+	return idx.withID(idx.blinded(key), id), true, nil
+}
+
+// withID 普通索引在值后拼接id; 唯一索引不拼接, 每个值只有一个key
+func (idx IndexInfo) withID(valueKey []byte, id string) []byte {
+	if idx.Unique {
+		return valueKey
+	}
+	return append(valueKey, id...)
+}
+
+// hasField 索引是否包含字段
+func (idx IndexInfo) hasField(field string) bool {
+	return slices.Contains(idx.Fields, field)
 }
 
 // H is a shortcut for map[string]any
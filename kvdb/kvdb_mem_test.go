@@ -1,11 +1,20 @@
 package kvdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type UserDemo struct {
@@ -38,11 +47,33 @@ func getAppDir(dirs ...string) string {
 func initdb() Table[UserDemo] {
 	dir := getAppDir("data")
 	fmt.Println("dir", dir)
-	InitMem(MemOptions{
+	db, err := Open(Options{
 		Mem: true,
-		//dir: dir,
+		//Dir: dir,
 	})
-	return NewTableMem[UserDemo]("userdemo")
+	if err != nil {
+		panic(err)
+	}
+	table, err := NewTable[UserDemo](db, "userdemo")
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// countKeys 统计pebble中以prefix开头的key数量
+func countKeys(t *testing.T, db *DB, prefix []byte) int {
+	t.Helper()
+	iter, err := db.pdb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
 }
 
 func TestMem(t *testing.T) {
@@ -148,3 +179,1821 @@ func TestMemInsert(t *testing.T) {
 		}
 	}
 }
+
+func TestTableCtxErrors(t *testing.T) {
+	tableMem := initdb().Ctx()
+	ctx := context.Background()
+	if _, err := tableMem.Get(ctx, "nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get missing: want ErrNotFound, got %v", err)
+	}
+	if err := tableMem.Update(ctx, "nope", H{"Age": 1}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("update missing: want ErrNotFound, got %v", err)
+	}
+	user := UserDemo{ID: "1", Name: "leo", Age: 11}
+	if err := tableMem.Insert(ctx, user.ID, &user); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := tableMem.Gets(ctx, "1", "2"); err != nil || len(list) != 1 {
+		t.Fatalf("gets: %v %v", list, err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := tableMem.Scan(canceled, func(v UserDemo) bool { return true }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("scan canceled: want context.Canceled, got %v", err)
+	}
+	if err := tableMem.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tableMem.Get(ctx, "1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("get closed: want ErrClosed, got %v", err)
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	tableMem := initdb()
+	user := UserDemo{ID: "1", Name: "leo", Age: 11}
+	if err := tableMem.Insert(user.ID, &user); err != nil {
+		t.Fatal(err)
+	}
+	boom := errors.New("boom")
+	err := tableMem.Txn(func(tx Tx[UserDemo]) error {
+		u2 := UserDemo{ID: "2", Name: "tom"}
+		if err := tx.Insert(u2.ID, &u2); err != nil {
+			return err
+		}
+		if err := tx.Update("1", H{"Name": "leo2"}); err != nil {
+			return err
+		}
+		if v, err := tx.Get("1"); err != nil || v.Name != "leo2" {
+			t.Fatalf("read own write: %v %v", v, err)
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("want boom, got %v", err)
+	}
+	if _, ok := tableMem.Get("2"); ok {
+		t.Fatal("insert was not rolled back")
+	}
+	if v, _ := tableMem.Get("1"); v.Name != "leo" {
+		t.Fatalf("update was not rolled back: %v", v)
+	}
+	if list := tableMem.SearchByIdx("idx_name", "leo2", func(v UserDemo) bool { return true }, 0, 10); len(list) != 0 {
+		t.Fatalf("index was not rolled back: %v", list)
+	}
+	if err := tableMem.Txn(func(tx Tx[UserDemo]) error { return tx.Delete("1") }); err != nil {
+		t.Fatal(err)
+	}
+	if list := tableMem.SearchByIdx("idx_name", "leo", func(v UserDemo) bool { return true }, 0, 10); len(list) != 0 {
+		t.Fatalf("index entry left after delete: %v", list)
+	}
+}
+
+func TestDBSharedTables(t *testing.T) {
+	db, err := Open(Options{Mem: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	users, _ := NewTable[UserDemo](db, "users")
+	others, _ := NewTable[UserDemo](db, "others")
+	err = db.Txn(func(b *Batch) error {
+		tu, err := Bind(b, users)
+		if err != nil {
+			return err
+		}
+		to, err := Bind(b, others)
+		if err != nil {
+			return err
+		}
+		if err := tu.Insert("1", &UserDemo{ID: "1", Name: "leo"}); err != nil {
+			return err
+		}
+		return to.Insert("1", &UserDemo{ID: "1", Name: "tom"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := users.Get("1")
+	o, _ := others.Get("1")
+	if u.Name != "leo" || o.Name != "tom" {
+		t.Fatalf("tables are not isolated: %v %v", u, o)
+	}
+	if list := others.SearchByIdx("idx_name", "leo", func(v UserDemo) bool { return true }, 0, 10); len(list) != 0 {
+		t.Fatalf("index leaked across tables: %v", list)
+	}
+
+	// 同名的表只打开一次
+	if again, err := NewTable[UserDemo](db, "users"); err != nil || again != users {
+		t.Fatalf("reopen: got a second instance, %v", err)
+	}
+	if _, err := NewTable[OrderDemo](db, "users"); err == nil {
+		t.Fatal("reopen with another type: want error")
+	}
+	users.Close()
+	if again, err := NewTable[UserDemo](db, "users"); err != nil || again == users {
+		t.Fatalf("reopen after Close: %v", err)
+	}
+}
+
+func TestOpenIndependent(t *testing.T) {
+	t.Parallel()
+	scratch, err := Open(Options{Mem: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := Open(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, _ := NewTable[UserDemo](scratch, "users")
+	t2, _ := NewTable[UserDemo](disk, "users")
+	if err := t1.Insert("1", &UserDemo{ID: "1", Name: "leo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := t2.Get("1"); ok {
+		t.Fatal("databases share state")
+	}
+	if err := scratch.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := t1.Ctx().Get(context.Background(), "1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want ErrClosed after DB.Close, got %v", err)
+	}
+	if err := t2.Insert("2", &UserDemo{ID: "2"}); err != nil {
+		t.Fatalf("closing one db affected another: %v", err)
+	}
+	if err := disk.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitMem(t *testing.T) {
+	dir := t.TempDir()
+	defer InitMem(MemOptions{Mem: true})
+	InitMem(MemOptions{Dir: dir})
+	users := NewTableMem[UserDemo]("users")
+	users.Insert("1", &UserDemo{ID: "1", Name: "leo"})
+	InitMem(MemOptions{Dir: dir})
+	if _, ok := NewTableMem[UserDemo]("users").Get("1"); !ok {
+		t.Fatal("same options should keep the default DB")
+	}
+	// 换到其他选项再换回来, 旧存储已关闭, 同一Dir可以重新打开
+	InitMem(MemOptions{Mem: true})
+	InitMem(MemOptions{Dir: dir})
+	if _, ok := NewTableMem[UserDemo]("users").Get("1"); !ok {
+		t.Fatal("data lost after reopening the default DB")
+	}
+}
+
+func TestImportLegacy(t *testing.T) {
+	dir := t.TempDir()
+	// 旧布局: 每个表一个mdb, 值是没有头部的msgpack
+	old, err := pebble.Open(filepath.Join(dir, "users", "mdb"), &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []UserDemo{{ID: "1", Name: "leo"}, {ID: "2", Name: "tom"}} {
+		bs, _ := marshal(u)
+		old.Set([]byte(u.ID), bs, pebble.Sync)
+	}
+	old.Close()
+
+	db, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewTable[UserDemo](db, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := users.Get("2"); !ok || u.Name != "tom" {
+		t.Fatalf("legacy record not imported: %v %v", u, ok)
+	}
+	if list := users.SearchByIdx("idx_name", "leo", func(v UserDemo) bool { return true }, 0, 10); len(list) != 1 {
+		t.Fatalf("index not rebuilt: %v", list)
+	}
+	users.Delete("1")
+	db.Close(context.Background())
+
+	// 只导入一次, 之后的删除不会被旧数据覆盖
+	db, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	users, _ = NewTable[UserDemo](db, "users")
+	if _, ok := users.Get("1"); ok {
+		t.Fatal("legacy data imported twice")
+	}
+}
+
+func TestCloseWaitsForInflight(t *testing.T) {
+	db, err := Open(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, _ := NewTable[UserDemo](db, "users")
+	for i := range 10 {
+		table.Insert(fmt.Sprintf("%d", i), &UserDemo{ID: fmt.Sprintf("%d", i)})
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go table.Scan(func(v UserDemo) bool {
+		select {
+		case <-started:
+		default:
+			close(started)
+			<-release
+		}
+		return true
+	})
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := db.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline while scan is running, got %v", err)
+	}
+	if err := table.Insert("x", &UserDemo{ID: "x"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("want ErrClosed for new writes, got %v", err)
+	}
+	close(release)
+	if err := db.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type OrderDemo struct {
+	ID     string
+	Amount int       `kvdb:"index:idx_amount"`
+	Price  float64   `kvdb:"index:idx_price"`
+	At     time.Time `kvdb:"index:idx_at"`
+}
+
+func TestRangeByIdx(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	orders, err := NewTable[OrderDemo](db, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := -5; i <= 12; i++ {
+		o := OrderDemo{
+			ID:     fmt.Sprintf("o%d", i),
+			Amount: i,
+			Price:  float64(i) / 2,
+			At:     base.Add(time.Duration(i) * time.Hour),
+		}
+		if err := orders.Insert(o.ID, &o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	amounts := func(list []OrderDemo) (out []int) {
+		for _, o := range list {
+			out = append(out, o.Amount)
+		}
+		return out
+	}
+	check := func(name string, got []OrderDemo, want ...int) {
+		t.Helper()
+		if fmt.Sprint(amounts(got)) != fmt.Sprint(want) {
+			t.Fatalf("%s: got %v, want %v", name, amounts(got), want)
+		}
+	}
+	check("inclusive", orders.RangeByIdx("idx_amount", 8, 11), 8, 9, 10, 11)
+	check("exclusive", orders.RangeByIdx("idx_amount", 8, 11, RangeOptions{LoExclusive: true, HiExclusive: true}), 9, 10)
+	check("negative", orders.RangeByIdx("idx_amount", nil, -3), -5, -4, -3)
+	check("desc limit", orders.RangeByIdx("idx_amount", 2, nil, RangeOptions{Desc: true, Limit: 3}), 12, 11, 10)
+	check("float", orders.RangeByIdx("idx_price", -1.5, 0.5), -3, -2, -1, 0, 1)
+	check("time", orders.RangeByIdx("idx_at", base.Add(9*time.Hour), nil), 9, 10, 11, 12)
+	check("string bound", orders.RangeByIdx("idx_amount", "10", "12"), 10, 11, 12)
+	check("equality", orders.SearchByIdx("idx_amount", 10, func(v OrderDemo) bool { return true }, 0, 10), 10)
+	if _, err := orders.Ctx().RangeByIdx(context.Background(), "nope", nil, nil); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("want ErrNoIndex, got %v", err)
+	}
+}
+
+func TestOrderedStringEncoding(t *testing.T) {
+	values := []string{"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "a\x00b", "ab", "b"}
+	for i := 1; i < len(values); i++ {
+		lo := appendOrderedString(nil, values[i-1])
+		hi := appendOrderedString(nil, values[i])
+		if string(lo) >= string(hi) {
+			t.Fatalf("%q should sort before %q", values[i-1], values[i])
+		}
+	}
+}
+
+type AccountDemo struct {
+	ID    string
+	Email string `kvdb:"uniqueIndex:idx_email"`
+	Name  string `kvdb:"index:idx_name"`
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	accounts, err := NewTable[AccountDemo](db, "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := AccountDemo{ID: "a", Email: "a@x.com", Name: "leo"}
+	b := AccountDemo{ID: "b", Email: "b@x.com", Name: "leo"}
+	if err := accounts.Insert(a.ID, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Insert(b.ID, &b); err != nil {
+		t.Fatal(err)
+	}
+	dup := AccountDemo{ID: "c", Email: "a@x.com"}
+	if err := accounts.Insert(dup.ID, &dup); !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("insert duplicate: want ErrUniqueViolation, got %v", err)
+	}
+	if _, ok := accounts.Get("c"); ok {
+		t.Fatal("rejected insert wrote the main record")
+	}
+	if err := accounts.Update("b", H{"Email": "a@x.com", "Name": "tom"}); !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("update duplicate: want ErrUniqueViolation, got %v", err)
+	}
+	if v, _ := accounts.Get("b"); v.Name != "leo" {
+		t.Fatalf("rejected update was applied: %v", v)
+	}
+	if err := accounts.Update("a", H{"Email": "new@x.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "new@x.com"); !ok || v.ID != "a" {
+		t.Fatalf("lookup new value: %v %v", v, ok)
+	}
+	if _, ok := accounts.GetByUnique("idx_email", "a@x.com"); ok {
+		t.Fatal("old unique value still resolves")
+	}
+	if err := accounts.Insert(dup.ID, &dup); err != nil {
+		t.Fatalf("freed value should be reusable: %v", err)
+	}
+	if _, err := accounts.Ctx().GetByUnique(context.Background(), "idx_name", "leo"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("non-unique index: want ErrNoIndex, got %v", err)
+	}
+}
+
+type TenantOrderDemo struct {
+	ID        string
+	Tenant    string    `kvdb:"index:idx_tenant_created,0"`
+	CreatedAt time.Time `kvdb:"index:idx_tenant_created,1"`
+	Amount    int
+}
+
+func TestCompositeIndex(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	orders, err := NewTable[TenantOrderDemo](db, "tenant_orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := orders.(*TableMem[TenantOrderDemo]).indexs["idx_tenant_created"]
+	if fmt.Sprint(idx.Fields) != "[Tenant CreatedAt]" {
+		t.Fatalf("fields: %v", idx.Fields)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// "a" 与 "a\x00b" 测试组合key的转义
+	for i, tenant := range []string{"a", "a\x00b", "a", "b", "a"} {
+		o := TenantOrderDemo{
+			ID:        fmt.Sprintf("o%d", i),
+			Tenant:    tenant,
+			CreatedAt: base.Add(time.Duration(10-i) * time.Hour),
+			Amount:    i,
+		}
+		if err := orders.Insert(o.ID, &o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(list []TenantOrderDemo) (out []string) {
+		for _, o := range list {
+			out = append(out, o.ID)
+		}
+		return out
+	}
+	all := func(v TenantOrderDemo) bool { return true }
+	if got := ids(orders.SearchByIdx("idx_tenant_created", IndexKey{"a"}, all, 0, 10)); fmt.Sprint(got) != "[o4 o2 o0]" {
+		t.Fatalf("tenant a by created: %v", got)
+	}
+	got := ids(orders.RangeByIdx("idx_tenant_created", IndexKey{"a"}, IndexKey{"a", base.Add(8 * time.Hour)}, RangeOptions{Desc: true}))
+	if fmt.Sprint(got) != "[o2 o4]" {
+		t.Fatalf("tenant a before 8h desc: %v", got)
+	}
+	if err := orders.Update("o0", H{"Tenant": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(orders.SearchByIdx("idx_tenant_created", IndexKey{"b"}, all, 0, 10)); fmt.Sprint(got) != "[o3 o0]" {
+		t.Fatalf("tenant b after update: %v", got)
+	}
+	if got := ids(orders.SearchByIdx("idx_tenant_created", "a", all, 0, 10)); fmt.Sprint(got) != "[o4 o2]" {
+		t.Fatalf("plain value as leading field: %v", got)
+	}
+}
+
+type NoteDemo struct {
+	Key  string `kvdb:"primaryKey"`
+	Text string
+}
+
+type SeqDemo struct {
+	No   int64 `kvdb:"primaryKey"`
+	Text string
+}
+
+func TestSavePrimaryKey(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	for _, kind := range []IDKind{IDULID, IDUUIDv7, IDSequence} {
+		notes, _ := NewTable[NoteDemo](db, fmt.Sprintf("notes%d", kind), TableOptions{IDKind: kind})
+		var prev string
+		for i := range 3 {
+			n := NoteDemo{Text: fmt.Sprintf("n%d", i)}
+			if err := notes.Save(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n.Key == "" || n.Key <= prev {
+				t.Fatalf("kind %d: generated key %q after %q", kind, n.Key, prev)
+			}
+			prev = n.Key
+			if v, ok := notes.Get(n.Key); !ok || v.Text != n.Text {
+				t.Fatalf("kind %d: get %q: %v %v", kind, n.Key, v, ok)
+			}
+		}
+		if kind == IDSequence && prev != "3" {
+			t.Fatalf("sequence: got %q", prev)
+		}
+	}
+	seqs, _ := NewTable[SeqDemo](db, "seqs")
+	boom := errors.New("boom")
+	seqs.Txn(func(tx Tx[SeqDemo]) error {
+		tx.Save(&SeqDemo{Text: "rolled back"})
+		return boom
+	})
+	s := SeqDemo{Text: "first"}
+	if err := seqs.Save(&s); err != nil || s.No != 1 {
+		t.Fatalf("sequence after rollback: %d %v", s.No, err)
+	}
+	s.Text = "changed"
+	if err := seqs.Save(&s); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := seqs.Get("1"); v.Text != "changed" {
+		t.Fatalf("save with key should overwrite: %v", v)
+	}
+	users, _ := NewTable[UserDemo](db, "users")
+	if err := users.Save(&UserDemo{}); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("want ErrNoKey, got %v", err)
+	}
+}
+
+func TestSearchPage(t *testing.T) {
+	tableMem := initdb()
+	for i := range 25 {
+		u := UserDemo{ID: fmt.Sprintf("u%02d", i), Name: is(i%2 == 0, "even", "odd"), Age: i}
+		tableMem.Insert(u.ID, &u)
+	}
+	var seen []int
+	var cursor Cursor
+	for pages := 0; ; pages++ {
+		page := tableMem.SearchByIdxPage("idx_name", "even", nil, cursor, 4)
+		for _, u := range page.Items {
+			seen = append(seen, u.Age)
+		}
+		if pages == 0 {
+			// 翻页过程中插入的记录不影响已返回的位置
+			tableMem.Insert("u00a", &UserDemo{ID: "u00a", Name: "even", Age: 100})
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if fmt.Sprint(seen) != "[0 2 4 6 8 10 12 14 16 18 20 22 24]" {
+		t.Fatalf("pages: %v", seen)
+	}
+	page := tableMem.SearchPage("u1", func(v UserDemo) bool { return v.Age%3 == 0 }, "", 2)
+	if len(page.Items) != 2 || page.Next == "" {
+		t.Fatalf("first page: %v", page)
+	}
+	page = tableMem.SearchPage("u1", func(v UserDemo) bool { return v.Age%3 == 0 }, page.Next, 2)
+	if len(page.Items) != 1 || page.Items[0].Age != 18 || page.Next != "" {
+		t.Fatalf("last page: %v", page)
+	}
+	if _, err := tableMem.Ctx().SearchPage(context.Background(), "u2", nil, encodeCursor("u1"), 2); err == nil {
+		t.Fatal("cursor from another range should be rejected")
+	}
+}
+
+func TestIterators(t *testing.T) {
+	tableMem := initdb()
+	for i := range 12 {
+		u := UserDemo{ID: fmt.Sprintf("u%02d", i), Name: is(i < 4, "a", "b"), Age: i}
+		tableMem.Insert(u.ID, &u)
+	}
+	all := maps.Collect(tableMem.All())
+	if len(all) != 12 || all["u07"].Age != 7 {
+		t.Fatalf("all: %v", all)
+	}
+	var ids []string
+	for id := range tableMem.Prefix("u1") {
+		ids = append(ids, id)
+	}
+	if fmt.Sprint(ids) != "[u10 u11]" {
+		t.Fatalf("prefix: %v", ids)
+	}
+	ids = ids[:0]
+	for id, v := range tableMem.ByIndex("idx_name", "a") {
+		if v.Age >= 2 {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if fmt.Sprint(ids) != "[u00 u01]" {
+		t.Fatalf("by index with break: %v", ids)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seq, errf := tableMem.Ctx().All(ctx)
+	n := 0
+	for range seq {
+		if n++; n == 3 {
+			cancel()
+		}
+	}
+	if n != 3 || !errors.Is(errf(), context.Canceled) {
+		t.Fatalf("canceled iteration: n=%d err=%v", n, errf())
+	}
+	if _, errf := tableMem.Ctx().ByIndex(context.Background(), "nope", 1); !errors.Is(errf(), ErrNoIndex) {
+		t.Fatalf("want ErrNoIndex, got %v", errf())
+	}
+}
+
+type SessionDemo struct {
+	ID   string        `kvdb:"primaryKey"`
+	User string        `kvdb:"index:idx_user"`
+	TTL  time.Duration `kvdb:"ttl"`
+}
+
+func TestTTL(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	sessions, err := NewTable[SessionDemo](db, "sessions", TableOptions{SweepInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Save(&SessionDemo{ID: "s1", User: "leo", TTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.InsertWithTTL("s2", &SessionDemo{ID: "s2", User: "leo"}, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.Insert("s3", &SessionDemo{ID: "s3", User: "leo"}); err != nil {
+		t.Fatal(err)
+	}
+	all := func(v SessionDemo) bool { return true }
+	if list := sessions.SearchByIdx("idx_user", "leo", all, 0, 10); len(list) != 3 {
+		t.Fatalf("before expiry: %v", list)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if _, ok := sessions.Get("s1"); ok {
+		t.Fatal("expired record returned by Get")
+	}
+	if list := sessions.SearchByIdx("idx_user", "leo", all, 0, 10); len(list) != 1 || list[0].ID != "s3" {
+		t.Fatalf("expired records returned by SearchByIdx: %v", list)
+	}
+	n := 0
+	sessions.Scan(func(v SessionDemo) bool { n++; return true })
+	if n != 1 {
+		t.Fatalf("expired records returned by Scan: %d", n)
+	}
+	swept, err := sessions.Ctx().Sweep(context.Background())
+	if err != nil || swept != 2 {
+		t.Fatalf("sweep: %d %v", swept, err)
+	}
+	if raw := countKeys(t, db, sessions.(*TableMem[SessionDemo]).iprefix); raw != 1 {
+		t.Fatalf("sweep left %d index entries", raw)
+	}
+
+	background, _ := NewTable[SessionDemo](db, "sessions_bg", TableOptions{SweepInterval: 10 * time.Millisecond})
+	background.InsertWithTTL("s1", &SessionDemo{ID: "s1"}, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if entries, _ := background.(*TableMem[SessionDemo]).expiredEntries(time.Now().Add(time.Hour)); len(entries) != 0 {
+		t.Fatalf("background sweeper did not run: %v", entries)
+	}
+}
+
+func TestTTLUnique(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	accounts, _ := NewTable[AccountDemo](db, "accounts", TableOptions{SweepInterval: -1})
+	tm := accounts.(*TableMem[AccountDemo])
+	if err := accounts.InsertWithTTL("a", &AccountDemo{ID: "a", Email: "a@x.com", Name: "leo"}, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// 尚未清理的过期记录不再占用唯一值
+	if err := accounts.Insert("b", &AccountDemo{ID: "b", Email: "a@x.com", Name: "tom"}); err != nil {
+		t.Fatalf("unique value of an expired record should be free: %v", err)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "a@x.com"); !ok || v.ID != "b" {
+		t.Fatalf("lookup: %+v %v", v, ok)
+	}
+	if entries, _ := tm.expiredEntries(time.Now().Add(time.Hour)); len(entries) != 0 {
+		t.Fatalf("expired owner not removed: %v", entries)
+	}
+	if r, err := accounts.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify: %+v %v", r, err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	accounts, err := NewTable[AccountDemo](db, "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := AccountDemo{ID: "a", Email: "a@x.com", Name: "leo"}
+	if err := accounts.Insert(a.ID, &a); err != nil {
+		t.Fatal(err)
+	}
+	_, v1, ok := accounts.GetWithVersion("a")
+	if !ok || v1 == 0 {
+		t.Fatalf("version after insert: %d %v", v1, ok)
+	}
+	if err := accounts.UpdateIf("a", v1, H{"Name": "tom"}); err != nil {
+		t.Fatal(err)
+	}
+	_, v2, _ := accounts.GetWithVersion("a")
+	if v2 <= v1 {
+		t.Fatalf("version did not increase: %d -> %d", v1, v2)
+	}
+	if err := accounts.UpdateIf("a", v1, H{"Name": "stale"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("stale UpdateIf: want ErrConflict, got %v", err)
+	}
+	if v, _ := accounts.Get("a"); v.Name != "tom" {
+		t.Fatalf("stale update was applied: %v", v)
+	}
+
+	// 删除后重新插入不复用版本号
+	accounts.Delete("a")
+	accounts.Insert(a.ID, &a)
+	if _, v3, _ := accounts.GetWithVersion("a"); v3 <= v2 {
+		t.Fatalf("reinsert reused version: %d after %d", v3, v2)
+	}
+
+	cur, _ := accounts.Get("a")
+	stale := cur
+	stale.Name = "other"
+	next := cur
+	next.Email = "b@x.com"
+	if err := accounts.CompareAndSwap("a", &stale, &next); !errors.Is(err, ErrConflict) {
+		t.Fatalf("CompareAndSwap mismatch: want ErrConflict, got %v", err)
+	}
+	if err := accounts.CompareAndSwap("a", &cur, &next); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "b@x.com"); !ok || v.ID != "a" {
+		t.Fatalf("swap did not move index: %v %v", v, ok)
+	}
+	if _, ok := accounts.GetByUnique("idx_email", "a@x.com"); ok {
+		t.Fatal("old index entry survived swap")
+	}
+	if err := accounts.CompareAndSwap("missing", &cur, &next); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CompareAndSwap missing: want ErrNotFound, got %v", err)
+	}
+	// old为nil: 仅在不存在时插入
+	fresh := AccountDemo{ID: "n", Email: "n@x.com", Name: "new"}
+	if err := accounts.CompareAndSwap("n", nil, &fresh); err != nil {
+		t.Fatalf("CompareAndSwap nil old on absent id: %v", err)
+	}
+	if err := accounts.CompareAndSwap("n", nil, &fresh); !errors.Is(err, ErrConflict) {
+		t.Fatalf("CompareAndSwap nil old on existing id: want ErrConflict, got %v", err)
+	}
+}
+
+func TestModify(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	orders, err := NewTable[OrderDemo](db, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := OrderDemo{ID: "o1", Amount: 10}
+	if err := orders.Insert(o.ID, &o); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := orders.Modify("o1", func(v *OrderDemo) error { v.Amount++; return nil }); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			orders.Update("o1", H{"Price": 1.5})
+		}()
+	}
+	wg.Wait()
+	v, _ := orders.Get("o1")
+	if v.Amount != 30 || v.Price != 1.5 {
+		t.Fatalf("lost updates: %+v", v)
+	}
+	if list := orders.RangeByIdx("idx_amount", 30, 30); len(list) != 1 {
+		t.Fatalf("index not moved: %v", list)
+	}
+	if list := orders.RangeByIdx("idx_amount", 10, 29); len(list) != 0 {
+		t.Fatalf("stale index entries: %v", list)
+	}
+
+	abort := errors.New("abort")
+	if err := orders.Modify("o1", func(v *OrderDemo) error { v.Amount = 0; return abort }); err != abort {
+		t.Fatalf("fn error: got %v", err)
+	}
+	if v, _ := orders.Get("o1"); v.Amount != 30 {
+		t.Fatalf("aborted Modify was written: %+v", v)
+	}
+	if err := orders.Modify("missing", func(v *OrderDemo) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing: want ErrNotFound, got %v", err)
+	}
+}
+
+type TagDemo struct {
+	ID string
+	P  *string `kvdb:"index:idx_p"`
+}
+
+func TestModifyDeepCopy(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	tags, _ := NewTable[TagDemo](db, "tags")
+	old := "old"
+	tags.Insert("a", &TagDemo{ID: "a", P: &old})
+	var seen string
+	tags.Hook(Hooks[TagDemo]{BeforeUpdate: func(tx Tx[TagDemo], id string, old, v *TagDemo) error {
+		seen = *old.P
+		return nil
+	}})
+	if err := tags.Modify("a", func(v *TagDemo) error { *v.P = "new"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "old" {
+		t.Fatalf("hook saw old value %q", seen)
+	}
+	if list := tags.SearchByIdx("idx_p", "new", func(TagDemo) bool { return true }); len(list) != 1 {
+		t.Fatalf("index not updated: %v", list)
+	}
+	err := tags.Txn(func(tx Tx[TagDemo]) error {
+		return tx.Modify("a", func(v *TagDemo) error { *v.P = "tx"; return nil })
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := tags.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify: %+v %v", r, err)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	accounts, err := NewTable[AccountDemo](db, "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := AccountDemo{ID: "a", Email: "a@x.com", Name: "leo"}
+	if ok, err := accounts.InsertIfAbsent(a.ID, &a); !ok || err != nil {
+		t.Fatalf("first InsertIfAbsent: %v %v", ok, err)
+	}
+	b := AccountDemo{ID: "a", Email: "b@x.com", Name: "tom"}
+	if ok, err := accounts.InsertIfAbsent(b.ID, &b); ok || err != nil {
+		t.Fatalf("second InsertIfAbsent: %v %v", ok, err)
+	}
+	if v, _ := accounts.Get("a"); v.Name != "leo" {
+		t.Fatalf("InsertIfAbsent overwrote: %v", v)
+	}
+
+	if err := accounts.Upsert(b.ID, &b); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := accounts.GetByUnique("idx_email", "a@x.com"); ok {
+		t.Fatal("stale unique entry after Upsert")
+	}
+	if list := accounts.SearchByIdx("idx_name", "leo", func(AccountDemo) bool { return true }); len(list) != 0 {
+		t.Fatalf("stale index entry after Upsert: %v", list)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "b@x.com"); !ok || v.Name != "tom" {
+		t.Fatalf("new entry: %v %v", v, ok)
+	}
+	// 旧值已释放, 其他记录可以使用
+	c := AccountDemo{ID: "c", Email: "a@x.com"}
+	if err := accounts.Insert(c.ID, &c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	accounts, err := NewTable[AccountDemo](db, "accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		a := AccountDemo{ID: id, Email: id + "@x.com", Name: "n" + id}
+		accounts.Insert(id, &a)
+	}
+	if r, err := accounts.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("clean table: %+v %v", r, err)
+	}
+
+	// 绕过表直接破坏索引
+	tm := accounts.(*TableMem[AccountDemo])
+	idxName := tm.indexs["idx_name"]
+	keyA, _ := idxName.entityKey(&AccountDemo{Name: "na"}, "a")
+	keyX, _ := idxName.entityKey(&AccountDemo{Name: "nx"}, "x")
+	keyC, _ := idxName.entityKey(&AccountDemo{Name: "old"}, "c")
+	db.pdb.Delete(tm.ikey(keyA), nil)
+	db.pdb.Set(tm.ikey(keyX), []byte("x"), nil)
+	db.pdb.Set(tm.ikey(keyC), []byte("c"), nil)
+	db.pdb.Set(tm.ikey([]byte("idx_dropped\x00v")), []byte("b"), nil)
+
+	r, err := accounts.VerifyIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Missing) != 1 || r.Missing[0].ID != "a" {
+		t.Fatalf("missing: %+v", r.Missing)
+	}
+	if len(r.Orphaned) != 2 {
+		t.Fatalf("orphaned: %+v", r.Orphaned)
+	}
+	if len(r.Mismatched) != 1 || r.Mismatched[0].ID != "c" || string(r.Mismatched[0].Key) != string(keyC) {
+		t.Fatalf("mismatched: %+v", r.Mismatched)
+	}
+	for _, p := range r.Orphaned {
+		if k := string(p.Key); k != string(keyX) && k != "idx_dropped\x00v" {
+			t.Fatalf("orphaned key %q", k)
+		}
+	}
+
+	if err := accounts.RebuildIndex("idx_name"); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = accounts.VerifyIndexes()
+	if len(r.Missing)+len(r.Mismatched) != 0 || len(r.Orphaned) != 1 {
+		t.Fatalf("after RebuildIndex: %+v", r)
+	}
+	if err := accounts.RebuildAllIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := accounts.VerifyIndexes(); !r.OK() {
+		t.Fatalf("after RebuildAllIndexes: %+v", r)
+	}
+	if list := accounts.SearchByIdx("idx_name", "nb", func(AccountDemo) bool { return true }); len(list) != 1 {
+		t.Fatalf("rebuild lost entry: %v", list)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "a@x.com"); !ok || v.ID != "a" {
+		t.Fatalf("unique index after rebuild: %v %v", v, ok)
+	}
+	if err := accounts.RebuildIndex("nope"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("unknown index: want ErrNoIndex, got %v", err)
+	}
+
+	// 分多批重建, 期间的写入照常维护索引
+	for i := range 3 * backfillBatch {
+		id := fmt.Sprintf("m%04d", i)
+		accounts.Insert(id, &AccountDemo{ID: id, Email: id + "@x.com", Name: "m"})
+	}
+	done := make(chan error)
+	go func() { done <- accounts.RebuildAllIndexes() }()
+	for i := range 200 {
+		id := fmt.Sprintf("m%04d", i*7)
+		accounts.Update(id, H{"Email": id + "@y.com"})
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if r, err := accounts.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("after online rebuild: %d %d %d %v", len(r.Orphaned), len(r.Missing), len(r.Mismatched), err)
+	}
+
+	// 重复的唯一值: 重建完成其余记录并报告重复, 修复前索引不能查询
+	bs, closer, _ := db.pdb.Get(tm.mkey("a"))
+	db.pdb.Set(tm.mkey("dup"), bs, nil)
+	closer.Close()
+	var dup *DuplicateError
+	if err := accounts.RebuildIndex("idx_email"); !errors.As(err, &dup) || !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("duplicate values: want DuplicateError, got %v", err)
+	}
+	if len(dup.Duplicates) != 1 || dup.Duplicates[0].ID != "dup" {
+		t.Fatalf("duplicates: %+v", dup.Duplicates)
+	}
+	if _, err := accounts.Ctx().GetByUnique(context.Background(), "idx_email", "b@x.com"); !errors.Is(err, ErrIndexBuilding) {
+		t.Fatalf("index with duplicates: want ErrIndexBuilding, got %v", err)
+	}
+	accounts.Delete("dup")
+	if err := accounts.RebuildIndex("idx_email"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "a@x.com"); !ok || v.ID != "a" {
+		t.Fatalf("after fixing duplicates: %v %v", v, ok)
+	}
+}
+
+type ItemV1 struct {
+	ID    string
+	Name  string `kvdb:"index:idx_name"`
+	Tag   string `kvdb:"index:idx_tag"`
+	Color string
+}
+
+type ItemV2 struct {
+	ID    string
+	Name  string
+	Tag   string `kvdb:"index:idx_tag"`
+	Color string `kvdb:"index:idx_color"`
+}
+
+func TestIndexSchemaChange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, _ := NewTable[ItemV1](db, "items")
+	const n = 1200 // 超过一批, 需要后台回填
+	err = v1.Txn(func(tx Tx[ItemV1]) error {
+		for i := range n {
+			id := fmt.Sprintf("%04d", i)
+			if err := tx.Insert(id, &ItemV1{ID: id, Name: "n" + id, Tag: "t", Color: []string{"red", "blue"}[i%2]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	db, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	var calls []IndexProgress
+	var mu sync.Mutex
+	v2, err := NewTable[ItemV2](db, "items", TableOptions{OnIndexProgress: func(p IndexProgress) {
+		mu.Lock()
+		calls = append(calls, p)
+		mu.Unlock()
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := v2.(*TableMem[ItemV2])
+	if c := countKeys(t, db, tm.ikey([]byte("idx_name\x00"))); c != 0 {
+		t.Fatalf("dropped index left %d entries", c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := v2.Ctx().WaitIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list := v2.SearchByIdx("idx_color", "red", func(ItemV2) bool { return true }, 0, n); len(list) != n/2 {
+		t.Fatalf("backfilled index: %d records", len(list))
+	}
+	if r, err := v2.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify: %+v %v", r, err)
+	}
+	mu.Lock()
+	last := calls[len(calls)-1]
+	mu.Unlock()
+	if len(calls) < 2 || !last.Finished || last.Total != n || last.Records != n || last.Indexes[0] != "idx_color" {
+		t.Fatalf("progress: %+v", calls)
+	}
+	db.Close(context.Background())
+
+	// 定义未变时不再回填
+	db, _ = Open(Options{Dir: dir})
+	defer db.Close(context.Background())
+	calls = nil
+	v2, _ = NewTable[ItemV2](db, "items", TableOptions{OnIndexProgress: func(p IndexProgress) { calls = append(calls, p) }})
+	if len(calls) != 0 {
+		t.Fatalf("unchanged schema backfilled: %+v", calls)
+	}
+	if list := v2.SearchByIdx("idx_color", "blue", func(ItemV2) bool { return true }, 0, n); len(list) != n/2 {
+		t.Fatalf("after reopen: %d records", len(list))
+	}
+}
+
+type ProfileV1 struct {
+	ID       string
+	FullName string
+	Age      string
+}
+
+type ProfileV2 struct {
+	ID   string
+	Name string `kvdb:"index:idx_name"`
+	Age  int
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, _ := NewTable[ProfileV1](db, "profiles")
+	for i := range 3 {
+		id := fmt.Sprint(i)
+		v1.Insert(id, &ProfileV1{ID: id, FullName: "user" + id, Age: fmt.Sprint(20 + i)})
+	}
+	db.Close(context.Background())
+
+	db, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	v2, err := NewTable[ProfileV2](db, "profiles", TableOptions{SchemaVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v2.Ctx().Get(context.Background(), "0"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("missing migration: want ErrCorrupt, got %v", err)
+	}
+	if r, err := v2.MigrateAll(); !errors.Is(err, ErrCorrupt) || r.Rewritten != 0 {
+		t.Fatalf("MigrateAll without migration: %+v %v", r, err)
+	}
+	v2.Migrate(0, func(raw map[string]any) (map[string]any, error) {
+		raw["Name"] = raw["FullName"]
+		delete(raw, "FullName")
+		age, err := strconv.Atoi(raw["Age"].(string))
+		raw["Age"] = age
+		return raw, err
+	})
+	if p, ok := v2.Get("1"); !ok || p.Name != "user1" || p.Age != 21 {
+		t.Fatalf("lazy migration: %+v %v", p, ok)
+	}
+
+	// 无法解码或升级失败的记录被隔离, 不影响其他记录
+	tm := v2.(*TableMem[ProfileV2])
+	bad, _ := marshal(map[string]any{"ID": "bad", "FullName": "x", "Age": "unknown"})
+	db.pdb.Set(tm.mkey("bad"), encodeRecord(recordHeader{}, bad), nil)
+	db.pdb.Set(tm.mkey("junk"), []byte{recordMagic}, nil)
+	r, err := v2.MigrateAll()
+	if err != nil || r.Rewritten != 3 || r.Quarantined != 2 {
+		t.Fatalf("MigrateAll: %+v %v", r, err)
+	}
+	if list, _ := v2.Quarantine(); len(list) != 2 {
+		t.Fatalf("corrupt records not quarantined: %+v", list)
+	}
+	if list := v2.SearchByIdx("idx_name", "user2", func(ProfileV2) bool { return true }); len(list) != 1 || list[0].Age != 22 {
+		t.Fatalf("index after MigrateAll: %+v", list)
+	}
+	if r, err := v2.MigrateAll(); err != nil || r != (RewriteResult{}) {
+		t.Fatalf("second MigrateAll: %+v %v", r, err)
+	}
+	// 写回后不再依赖迁移函数
+	tm.migrations = nil
+	if p, ok := v2.Get("0"); !ok || p.Name != "user0" {
+		t.Fatalf("after MigrateAll: %+v %v", p, ok)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	profiles, err := NewTable[ProfileV2](db, "profiles", TableOptions{SchemaVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := profiles.(*TableMem[ProfileV2])
+	migrate := func(raw map[string]any) (map[string]any, error) {
+		age, err := strconv.Atoi(raw["Age"].(string))
+		return map[string]any{"ID": raw["ID"], "Name": raw["FullName"], "Age": age}, err
+	}
+	// 模拟旧版本结构写入的记录和无法解析的值
+	old, _ := marshal(map[string]any{"ID": "old", "FullName": "leo", "Age": "thirty"})
+	db.pdb.Set(tm.mkey("old"), encodeRecord(recordHeader{}, old), nil)
+	junk, _ := marshal("junk")
+	db.pdb.Set(tm.mkey("junk"), junk, nil)
+
+	// 缺少迁移函数不是记录的问题, 不隔离
+	for range 2 {
+		if _, err := profiles.Ctx().Get(context.Background(), "old"); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("want ErrCorrupt, got %v", err)
+		}
+	}
+	profiles.Migrate(0, migrate)
+	if _, err := profiles.Ctx().Get(context.Background(), "old"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("failed migration: want ErrCorrupt, got %v", err)
+	}
+	if _, ok := profiles.Get("junk"); ok {
+		t.Fatal("junk decoded")
+	}
+	if _, err := profiles.Ctx().Get(context.Background(), "old"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("quarantined record still in table: %v", err)
+	}
+	list, err := profiles.Quarantine()
+	if err != nil || len(list) != 2 || list[1].ID != "old" || list[1].Reason == "" {
+		t.Fatalf("Quarantine: %+v %v", list, err)
+	}
+	raw, err := profiles.InspectQuarantine("old")
+	if err != nil || raw["Age"] != "thirty" {
+		t.Fatalf("InspectQuarantine: %v %v", raw, err)
+	}
+	if _, err := profiles.InspectQuarantine("junk"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("inspect junk: want ErrCorrupt, got %v", err)
+	}
+
+	if err := profiles.RestoreQuarantine("old", nil); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("restore without fix: want ErrCorrupt, got %v", err)
+	}
+	profiles.Migrate(0, func(raw map[string]any) (map[string]any, error) {
+		if raw["Age"] == "thirty" {
+			raw["Age"] = "30"
+		}
+		return migrate(raw)
+	})
+	if err := profiles.RestoreQuarantine("old", nil); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := profiles.Get("old"); !ok || p.Name != "leo" || p.Age != 30 {
+		t.Fatalf("restored: %+v %v", p, ok)
+	}
+	if list := profiles.SearchByIdx("idx_name", "leo", func(ProfileV2) bool { return true }); len(list) != 1 {
+		t.Fatalf("restored record not indexed: %v", list)
+	}
+	if err := profiles.RestoreQuarantine("junk", &ProfileV2{ID: "junk", Name: "fixed"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := profiles.Quarantine(); len(list) != 0 {
+		t.Fatalf("quarantine not emptied: %+v", list)
+	}
+	if err := profiles.RestoreQuarantine("junk", nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("restore twice: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestQuarantineIndexes(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	ctx := context.Background()
+	accounts, _ := NewTable[AccountDemo](db, "accounts", TableOptions{SweepInterval: -1})
+	tm := accounts.(*TableMem[AccountDemo])
+	accounts.InsertWithTTL("1", &AccountDemo{ID: "1", Email: "a@x.com", Name: "leo"}, time.Hour)
+	// 保留头部(过期时间), 只破坏payload
+	bs, closer, _ := db.pdb.Get(tm.mkey("1"))
+	h, _, _ := decodeRecord(bs)
+	closer.Close()
+	db.pdb.Set(tm.mkey("1"), encodeRecord(recordHeader{expireAt: h.expireAt}, []byte{0xc1}), nil)
+	tm.cache.Clear()
+	if _, err := accounts.Ctx().Get(ctx, "1"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt, got %v", err)
+	}
+	if _, closer, err := db.pdb.Get(tm.xkey(h.expireAt, "1")); err == nil {
+		closer.Close()
+		t.Fatal("expiry entry of a quarantined record kept")
+	}
+	if err := accounts.Insert("2", &AccountDemo{ID: "2", Email: "a@x.com", Name: "leo"}); err != nil {
+		t.Fatalf("unique value of a quarantined record should be free: %v", err)
+	}
+	if r, err := accounts.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify after quarantine: %+v %v", r, err)
+	}
+	if err := accounts.RestoreQuarantine("1", &AccountDemo{ID: "1", Email: "b@x.com", Name: "tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "b@x.com"); !ok || v.ID != "1" {
+		t.Fatalf("restored record not indexed: %+v %v", v, ok)
+	}
+	if r, err := accounts.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify after restore: %+v %v", r, err)
+	}
+
+	// 能按通用map解码时直接算出索引key; 隔离记为删除, Watch可以看到
+	logged, _ := NewTable[AccountDemo](db, "accounts_log", TableOptions{SweepInterval: -1, ChangeLog: 100})
+	lm := logged.(*TableMem[AccountDemo])
+	logged.Insert("3", &AccountDemo{ID: "3", Email: "c@x.com", Name: "amy"})
+	events := logged.Ctx().Watch(ctx, WatchFilter{})
+	bad, _ := marshal(map[string]any{"ID": []int{3}, "Email": "c@x.com", "Name": "amy"})
+	db.pdb.Set(lm.mkey("3"), bad, nil)
+	lm.cache.Clear()
+	if keys, ok := lm.candidateKeys("3", bad); !ok || len(keys) != 2 {
+		t.Fatalf("candidate keys: %q %v", keys, ok)
+	}
+	if _, err := logged.Ctx().Get(ctx, "3"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt, got %v", err)
+	}
+	if r, err := logged.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify after quarantine: %+v %v", r, err)
+	}
+	select {
+	case e := <-events:
+		if e.Op != OpDelete || e.ID != "3" {
+			t.Fatalf("quarantine event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("quarantine not in the change log")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := NewTable[UserDemo](db, "users", TableOptions{Codec: JSONCodec})
+	for i := range 3 {
+		id := fmt.Sprint(i)
+		users.Insert(id, &UserDemo{ID: id, Name: "u" + id, Age: 20 + i})
+	}
+	users.Update("1", H{"Age": 99})
+	db.Close(context.Background())
+
+	// 换成CBOR后旧的JSON记录仍可读取, MigrateAll改用新codec写回
+	db, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	users, _ = NewTable[UserDemo](db, "users", TableOptions{Codec: CBORCodec})
+	if u, ok := users.Get("1"); !ok || u.Age != 99 || u.Name != "u1" {
+		t.Fatalf("read JSON record: %+v %v", u, ok)
+	}
+	users.Insert("3", &UserDemo{ID: "3", Name: "u3"})
+	if r, err := users.MigrateAll(); err != nil || r.Rewritten != 3 {
+		t.Fatalf("MigrateAll: %+v %v", r, err)
+	}
+	tm := users.(*TableMem[UserDemo])
+	bs, closer, _ := db.pdb.Get(tm.mkey("2"))
+	h, _, _ := decodeRecord(bs)
+	closer.Close()
+	if h.codec != CodecCBOR {
+		t.Fatalf("record codec after MigrateAll: %d", h.codec)
+	}
+	if list := users.SearchByIdx("idx_name", "u2", func(UserDemo) bool { return true }); len(list) != 1 || list[0].Age != 22 {
+		t.Fatalf("after MigrateAll: %+v", list)
+	}
+
+	words, err := NewTable[wrapperspb.StringValue](db, "words", TableOptions{Codec: ProtoCodec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := words.Insert("a", wrapperspb.String("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := words.Ctx().Get(context.Background(), "a"); err != nil || w.GetValue() != "hello" {
+		t.Fatalf("proto record: %q %v", w.GetValue(), err)
+	}
+	if _, err := NewTable[UserDemo](db, "bad", TableOptions{Codec: ProtoCodec}); err == nil {
+		t.Fatal("proto codec accepted a non-proto type")
+	}
+}
+
+type BlobDemo struct {
+	ID   string
+	Body string
+}
+
+func TestCompression(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	big := strings.Repeat("lorem ipsum dolor sit amet ", 200)
+	header := func(tm *TableMem[BlobDemo], id string) recordHeader {
+		bs, closer, err := db.pdb.Get(tm.mkey(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closer.Close()
+		h, _, _ := decodeRecord(bs)
+		return h
+	}
+
+	dict := []byte(strings.Repeat("lorem ipsum dolor sit amet ", 10))
+	for _, o := range []TableOptions{
+		{Compression: CompressSnappy},
+		{Compression: CompressZstd},
+		{Compression: CompressZstd, ZstdDicts: [][]byte{dict}},
+	} {
+		name := fmt.Sprintf("blobs%d_%d", o.Compression, len(o.ZstdDicts))
+		blobs, _ := NewTable[BlobDemo](db, name, o)
+		tm := blobs.(*TableMem[BlobDemo])
+		if err := blobs.Insert("big", &BlobDemo{ID: "big", Body: big}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := blobs.Insert("small", &BlobDemo{ID: "small", Body: "x"}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if h := header(tm, "big"); h.compress == 0 {
+			t.Fatalf("%s: big record not compressed", name)
+		}
+		if h := header(tm, "small"); h.compress != 0 {
+			t.Fatalf("%s: small record compressed", name)
+		}
+		if b, ok := blobs.Get("big"); !ok || b.Body != big {
+			t.Fatalf("%s: round trip failed", name)
+		}
+		tm.cache.Clear()
+
+		// 关闭压缩或换字典后旧记录仍可读取
+		tm.opts.Compression = CompressNone
+		tm.opts.ZstdDicts = append([][]byte{[]byte("another dictionary")}, o.ZstdDicts...)
+		if err := blobs.Insert("plain", &BlobDemo{ID: "plain", Body: big}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if h := header(tm, "plain"); h.compress != 0 {
+			t.Fatalf("%s: compressed with CompressNone", name)
+		}
+		if b, ok := blobs.Get("big"); !ok || b.Body != big {
+			t.Fatalf("%s: old compressed record unreadable", name)
+		}
+	}
+
+	// 记录变小或关闭压缩后重写, 头部不能沿用旧的压缩算法
+	shrink, _ := NewTable[BlobDemo](db, "blobs_shrink", TableOptions{Compression: CompressSnappy, CompressMin: 64})
+	stm := shrink.(*TableMem[BlobDemo])
+	shrink.Insert("a", &BlobDemo{ID: "a", Body: big})
+	shrink.Insert("b", &BlobDemo{ID: "b", Body: big})
+	if err := shrink.Update("a", H{"Body": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	stm.cache.Clear()
+	if v, err := shrink.Ctx().Get(context.Background(), "a"); err != nil || v.Body != "x" {
+		t.Fatalf("shrunk record: %+v %v", v, err)
+	}
+	stm.opts.Compression = CompressNone
+	stm.opts.SchemaVersion = 1
+	shrink.Migrate(0, func(raw map[string]any) (map[string]any, error) { return raw, nil })
+	if r, err := shrink.MigrateAll(); err != nil || r.Rewritten != 2 {
+		t.Fatalf("MigrateAll: %+v %v", r, err)
+	}
+	stm.cache.Clear()
+	if h := header(stm, "b"); h.compress != 0 {
+		t.Fatal("rewritten record still marked compressed")
+	}
+	if v, err := shrink.Ctx().Get(context.Background(), "b"); err != nil || v.Body != big {
+		t.Fatalf("after MigrateAll: %v", err)
+	}
+
+	blobs, _ := NewTable[BlobDemo](db, "blobs_dict", TableOptions{Compression: CompressZstd, ZstdDicts: [][]byte{dict}})
+	if err := blobs.Insert("big", &BlobDemo{ID: "big", Body: big}); err != nil {
+		t.Fatal(err)
+	}
+	tm := blobs.(*TableMem[BlobDemo])
+	tm.cache.Clear()
+	tm.opts.ZstdDicts = nil
+	if _, err := blobs.Ctx().Get(context.Background(), "big"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("missing dictionary: want ErrCorrupt, got %v", err)
+	}
+	if list, _ := blobs.Quarantine(); len(list) != 0 {
+		t.Fatal("record quarantined for a missing dictionary")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close(context.Background()) }()
+	plain, _ := NewTable[AccountDemo](db, "accounts")
+	plain.Insert("old", &AccountDemo{ID: "old", Email: "old@secret.com", Name: "old"})
+	db.Close(context.Background())
+
+	keys := &StaticKeys{
+		Current: 1,
+		Keys:    map[uint32][]byte{1: []byte("0123456789abcdef0123456789abcdef")},
+		Blind:   []byte("blind-index-key"),
+	}
+	db, _ = Open(Options{Dir: dir})
+	accounts, err := NewTable[AccountDemo](db, "accounts", TableOptions{Keys: keys, BlindIndexes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := accounts.Ctx().WaitIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	accounts.Insert("a", &AccountDemo{ID: "a", Email: "a@secret.com", Name: "alice"})
+	tm := accounts.(*TableMem[AccountDemo])
+	leaks := func() (n int) {
+		iter, _ := db.pdb.NewIter(&pebble.IterOptions{LowerBound: tm.mprefix[:4], UpperBound: prefixEnd(tm.mprefix[:4])})
+		defer iter.Close()
+		for iter.First(); iter.Valid(); iter.Next() {
+			if strings.Contains(string(iter.Key())+string(iter.Value()), "secret") {
+				n++
+			}
+		}
+		return n
+	}
+	if n := leaks(); n != 1 {
+		t.Fatalf("want only the pre-encryption record in plaintext, got %d", n)
+	}
+	if v, ok := accounts.GetByUnique("idx_email", "a@secret.com"); !ok || v.Name != "alice" {
+		t.Fatalf("blinded lookup: %+v %v", v, ok)
+	}
+	if v, ok := accounts.Get("old"); !ok || v.Email != "old@secret.com" {
+		t.Fatalf("unencrypted record: %+v %v", v, ok)
+	}
+	if _, err := accounts.Ctx().RangeByIdx(ctx, "idx_name", "a", "z"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("range on blinded index: want ErrNoIndex, got %v", err)
+	}
+
+	// 同一个id配置了错误的密钥: 报告ErrCorrupt但不隔离
+	tm.opts.Keys = &StaticKeys{Current: 1, Keys: map[uint32][]byte{1: []byte("ffffffffffffffffffffffffffffffff")}}
+	tm.cache.Clear()
+	if _, err := accounts.Ctx().Get(ctx, "a"); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("wrong key: want ErrCorrupt, got %v", err)
+	}
+	if list, _ := accounts.Quarantine(); len(list) != 0 {
+		t.Fatal("record quarantined for a wrong key")
+	}
+	tm.opts.Keys = keys
+
+	// 轮换到密钥2
+	keys.Keys[2] = []byte("fedcba9876543210")
+	keys.Current = 2
+	accounts.Insert("b", &AccountDemo{ID: "b", Email: "b@secret.com", Name: "bob"})
+	if r, err := accounts.Rekey(); err != nil || r.Rewritten != 2 {
+		t.Fatalf("Rekey: %+v %v", r, err)
+	}
+	if n := leaks(); n != 0 {
+		t.Fatalf("%d plaintext values after Rekey", n)
+	}
+	delete(keys.Keys, 1)
+	tm.cache.Clear()
+	for _, id := range []string{"old", "a", "b"} {
+		if _, err := accounts.Ctx().Get(ctx, id); err != nil {
+			t.Fatalf("after rotation %s: %v", id, err)
+		}
+	}
+	if r, err := accounts.VerifyIndexes(); err != nil || !r.OK() {
+		t.Fatalf("verify: %+v %v", r, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	accounts, err := NewTable[AccountDemo](db, "accounts", TableOptions{ChangeLog: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	next := func(ch <-chan Event[AccountDemo]) Event[AccountDemo] {
+		t.Helper()
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				t.Fatal("watch channel closed")
+			}
+			return e
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for event")
+		}
+		return Event[AccountDemo]{}
+	}
+
+	live := accounts.Watch(ctx, WatchFilter{})
+	accounts.Insert("a", &AccountDemo{ID: "a", Name: "leo"})
+	accounts.Update("a", H{"Name": "tom"})
+	accounts.Delete("a")
+	ins, upd, del := next(live), next(live), next(live)
+	if ins.Op != OpInsert || ins.Old != nil || ins.New.Name != "leo" {
+		t.Fatalf("insert event: %+v", ins)
+	}
+	if upd.Op != OpUpdate || upd.Old.Name != "leo" || upd.New.Name != "tom" || upd.Seq != ins.Seq+1 {
+		t.Fatalf("update event: %+v", upd)
+	}
+	if del.Op != OpDelete || del.Old.Name != "tom" || del.New != nil {
+		t.Fatalf("delete event: %+v", del)
+	}
+
+	// 从检查点恢复, 并按前缀和类型过滤
+	accounts.Insert("user:1", &AccountDemo{ID: "user:1", Email: "u@x.com"})
+	accounts.Insert("other", &AccountDemo{ID: "other", Email: "o@x.com"})
+	accounts.Update("user:1", H{"Name": "x"})
+	resumed := accounts.Watch(ctx, WatchFilter{From: upd.Seq + 1, Prefix: "user:", Ops: []Op{OpUpdate}})
+	if e := next(resumed); e.Op != OpUpdate || e.ID != "user:1" || e.New.Name != "x" {
+		t.Fatalf("filtered event: %+v", e)
+	}
+
+	// 只保留4条, 更早的检查点收到ErrCompacted后从最旧的日志继续
+	stale := accounts.Watch(ctx, WatchFilter{From: ins.Seq})
+	if e := next(stale); !errors.Is(e.Err, ErrCompacted) {
+		t.Fatalf("want ErrCompacted, got %+v", e)
+	}
+	if e := next(stale); e.Op != OpDelete || e.Seq != del.Seq {
+		t.Fatalf("first retained event: %+v", e)
+	}
+
+	// MigrateAll之类的重写不产生事件
+	tm := accounts.(*TableMem[AccountDemo])
+	if _, err := tm.rewrite(ctx, "rewrite", func(recordHeader) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	accounts.Delete("other")
+	if e := next(live); e.Op != OpInsert || e.ID != "user:1" {
+		t.Fatalf("live insert: %+v", e)
+	}
+	next(live)
+	next(live)
+	if e := next(live); e.Op != OpDelete || e.ID != "other" {
+		t.Fatalf("rewrite should not be logged: %+v", e)
+	}
+
+	plain, _ := NewTable[AccountDemo](db, "plain")
+	if e := next(plain.Watch(ctx, WatchFilter{})); e.Err == nil {
+		t.Fatal("watch without change log should fail")
+	}
+	wctx, wcancel := context.WithCancel(ctx)
+	w := accounts.Watch(wctx, WatchFilter{})
+	wcancel()
+	if _, ok := <-w; ok {
+		t.Fatal("channel should close after cancel")
+	}
+}
+
+type MemberDemo struct {
+	ID        string
+	Email     string `kvdb:"uniqueIndex:idx_email"`
+	Name      string
+	CreatedAt time.Time `kvdb:"createdAt"`
+	UpdatedAt time.Time `kvdb:"updatedAt"`
+}
+
+func (m *MemberDemo) Validate() error {
+	if m.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(context.Background())
+	ctx := context.Background()
+	members, err := NewTable[MemberDemo](db, "members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalize := func(tx Tx[MemberDemo], id string, v *MemberDemo) error {
+		v.Email = strings.ToLower(v.Email)
+		return nil
+	}
+	var inserted, deleted []string
+	members.Hook(Hooks[MemberDemo]{
+		BeforeInsert: normalize,
+		BeforeUpdate: func(tx Tx[MemberDemo], id string, old, v *MemberDemo) error { return normalize(tx, id, v) },
+		AfterInsert: func(tx Tx[MemberDemo], id string, v *MemberDemo) error {
+			inserted = append(inserted, id)
+			return nil
+		},
+		BeforeDelete: func(tx Tx[MemberDemo], id string, v *MemberDemo) error {
+			if id == "admin" {
+				return errors.New("admin cannot be deleted")
+			}
+			return nil
+		},
+		AfterDelete: func(tx Tx[MemberDemo], id string, v *MemberDemo) error {
+			deleted = append(deleted, v.Email)
+			return nil
+		},
+	})
+
+	if err := members.Insert("x", &MemberDemo{ID: "x"}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("want ErrInvalid, got %v", err)
+	}
+	if _, ok := members.Get("x"); ok || len(inserted) != 0 {
+		t.Fatal("rejected insert was written")
+	}
+	if err := members.Insert("a", &MemberDemo{ID: "a", Email: "A@X.com", Name: "leo"}); err != nil {
+		t.Fatal(err)
+	}
+	a, ok := members.GetByUnique("idx_email", "a@x.com")
+	if !ok || a.CreatedAt.IsZero() || !a.UpdatedAt.Equal(a.CreatedAt) {
+		t.Fatalf("normalized insert: %+v %v", a, ok)
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := members.Update("a", H{"Email": "B@X.com"}); err != nil {
+		t.Fatal(err)
+	}
+	b, ok := members.GetByUnique("idx_email", "b@x.com")
+	if !ok || !b.CreatedAt.Equal(a.CreatedAt) || !b.UpdatedAt.After(a.UpdatedAt) {
+		t.Fatalf("normalized update: %+v %v", b, ok)
+	}
+	if _, ok := members.GetByUnique("idx_email", "a@x.com"); ok {
+		t.Fatal("old email still indexed")
+	}
+	if err := members.Update("a", H{"Name": ""}); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("update: want ErrInvalid, got %v", err)
+	}
+	// 覆盖写入时createdAt保留旧值
+	if err := members.Insert("a", &MemberDemo{ID: "a", Email: "c@x.com", Name: "tom"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := members.Get("a"); v.Name != "tom" || !v.CreatedAt.Equal(a.CreatedAt) {
+		t.Fatalf("overwrite: %+v", v)
+	}
+	if len(inserted) != 1 {
+		t.Fatalf("AfterInsert calls: %v", inserted)
+	}
+
+	members.Insert("admin", &MemberDemo{ID: "admin", Name: "root"})
+	if err := members.Ctx().Delete(ctx, "a", "admin"); err == nil {
+		t.Fatal("BeforeDelete should reject admin")
+	}
+	if _, ok := members.Get("a"); !ok {
+		t.Fatal("rejected delete should roll back the whole transaction")
+	}
+	deleted = nil
+	if err := members.Ctx().Delete(ctx, "a"); err != nil || len(deleted) != 1 || deleted[0] != "c@x.com" {
+		t.Fatalf("delete: %v %v", err, deleted)
+	}
+
+	// 钩子通过tx.Batch()在同一事务中写其他表; 直接调用表的写方法不会死锁
+	audit, _ := NewTable[NoteDemo](db, "member_audit")
+	members.Hook(Hooks[MemberDemo]{
+		AfterUpdate: func(tx Tx[MemberDemo], id string, old, v *MemberDemo) error {
+			if v.Name == "nested" {
+				return audit.Insert(id, &NoteDemo{Key: id, Text: v.Name})
+			}
+			at, err := Bind(tx.Batch(), audit)
+			if err != nil {
+				return err
+			}
+			return at.Insert(id, &NoteDemo{Key: id, Text: v.Name})
+		},
+	})
+	if err := members.Update("admin", H{"Name": "boss"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := audit.Get("admin"); !ok {
+		t.Fatal("audit row not written in the hook's transaction")
+	}
+	done := make(chan error, 1)
+	go func() { done <- members.Update("admin", H{"Name": "nested"}) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNestedTxn) {
+			t.Fatalf("write from a hook: want ErrNestedTxn, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write from a hook deadlocked")
+	}
+
+	type BadStamp struct {
+		ID        string
+		UpdatedAt int64 `kvdb:"updatedAt"`
+	}
+	if _, err := NewTable[BadStamp](db, "bad_stamp"); err == nil {
+		t.Fatal("non-time.Time timestamp field should be rejected")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: filepath.Join(dir, "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+	accounts, _ := NewTable[AccountDemo](db, "accounts")
+	for i := range 10 {
+		id := strconv.Itoa(i)
+		accounts.Insert(id, &AccountDemo{ID: id, Email: id + "@x.com", Name: "leo"})
+	}
+	db.pdb.Flush()
+	full := filepath.Join(dir, "full")
+	if err := db.Backup(ctx, full); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Backup(ctx, full); err == nil {
+		t.Fatal("backup into an existing dir should fail")
+	}
+	accounts.Insert("new", &AccountDemo{ID: "new", Email: "new@x.com"})
+	accounts.Delete("0")
+	incr := filepath.Join(dir, "incr")
+	if err := db.Backup(ctx, incr, BackupOptions{Base: full}); err != nil {
+		t.Fatal(err)
+	}
+	ssts, _ := filepath.Glob(filepath.Join(full, "*.sst"))
+	if len(ssts) == 0 {
+		t.Fatal("full backup has no table files")
+	}
+	for _, f := range ssts {
+		a, _ := os.Stat(f)
+		b, err := os.Stat(filepath.Join(incr, filepath.Base(f)))
+		if err != nil || !os.SameFile(a, b) {
+			t.Fatalf("incremental backup should link %s: %v", filepath.Base(f), err)
+		}
+	}
+
+	// 全量备份恢复到磁盘, 增量备份恢复到内存
+	check := func(db *DB, deleted string, present string) {
+		t.Helper()
+		restored, err := NewTable[AccountDemo](db, "accounts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := restored.Get(deleted); ok {
+			t.Fatalf("%s should be absent", deleted)
+		}
+		if v, ok := restored.GetByUnique("idx_email", present+"@x.com"); !ok || v.ID != present {
+			t.Fatalf("index lookup of %s: %+v %v", present, v, ok)
+		}
+		if r, err := restored.VerifyIndexes(); err != nil || !r.OK() {
+			t.Fatalf("verify: %+v %v", r, err)
+		}
+	}
+	fromFull, err := Restore(full, Options{Dir: filepath.Join(dir, "restored")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fromFull, "new", "0")
+	if err := fromFull.Backup(ctx, filepath.Join(dir, "other"), BackupOptions{Base: full}); err == nil {
+		t.Fatal("a restored store should not use the original's backups as base")
+	}
+	fromFull.Close(ctx)
+	fromIncr, err := Restore(incr, Options{Mem: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fromIncr, "0", "new")
+	if _, err := Restore(filepath.Join(dir, "missing"), Options{Mem: true}); err == nil {
+		t.Fatal("restore from a missing backup should fail")
+	}
+
+	// Mem模式的DB也能备份到磁盘
+	memBackup := filepath.Join(dir, "mem")
+	if err := fromIncr.Backup(ctx, memBackup); err != nil {
+		t.Fatal(err)
+	}
+	fromIncr.Close(ctx)
+	fromMem, err := Open(Options{Dir: memBackup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fromMem, "0", "new")
+	fromMem.Close(ctx)
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	db, _ := Open(Options{Mem: true})
+	defer db.Close(ctx)
+	accounts, _ := NewTable[AccountDemo](db, "accounts")
+	for i := range 100 {
+		id := strconv.Itoa(i)
+		accounts.Insert(id, &AccountDemo{ID: id, Email: id + "@x.com"})
+	}
+	var buf strings.Builder
+	if err := db.Snapshot(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.String()
+
+	loaded, err := LoadSnapshot(strings.NewReader(snap), Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, _ := NewTable[AccountDemo](loaded, "accounts")
+	if v, ok := copied.GetByUnique("idx_email", "42@x.com"); !ok || v.ID != "42" {
+		t.Fatalf("lookup after load: %+v %v", v, ok)
+	}
+	if _, err := LoadSnapshot(strings.NewReader(snap), Options{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Close(ctx)
+
+	corrupt := []byte(snap)
+	corrupt[len(corrupt)/2] ^= 0xff
+	for name, data := range map[string]string{
+		"corrupt":   string(corrupt),
+		"truncated": snap[:len(snap)-10],
+		"garbage":   "not a snapshot",
+	} {
+		if _, err := LoadSnapshot(strings.NewReader(data), Options{Mem: true}); err == nil {
+			t.Fatalf("%s snapshot should fail to load", name)
+		}
+	}
+}
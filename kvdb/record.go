@@ -0,0 +1,159 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// 主记录的值: 早期版本直接存msgpack; 现在以recordMagic开头, 后跟flags和
+// flags声明的头部字段, 最后是编码后的实体. 0xc1在msgpack中从不使用, 两种
+// 格式可以共存.
+//
+//	0xc1 flags [expireAt int64] [version uvarint] [schema uvarint] [codec byte]
+//	     [compress byte [dict uint32]] [keyID uint32 dekLen uvarint dek] payload
+const recordMagic byte = 0xc1
+
+const (
+	flagExpire   byte = 1 << iota // 带过期时间
+	flagVersion                   // 带版本号
+	flagSchema                    // 带结构版本号
+	flagCodec                     // 带codec id, 没有时为msgpack
+	flagCompress                  // payload已压缩
+	flagEncrypt                   // payload已加密
+)
+
+type recordHeader struct {
+	expireAt int64  // 过期时间(unix纳秒), 0表示永不过期
+	version  uint64 // 写入版本号, 表内单调递增; 旧记录为0
+	schema   uint32 // 写入时T的结构版本, 见TableOptions.SchemaVersion
+	codec    byte   // 编码payload的codec, 见Codec
+	compress byte   // 压缩算法, 0表示未压缩
+	dict     uint32 // 压缩使用的zstd字典id
+	keyID    uint32 // 加密dek的密钥id
+	dek      []byte // 被加密的数据密钥, nil表示未加密
+}
+
+func (h recordHeader) expired(now time.Time) bool {
+	return h.expireAt != 0 && now.UnixNano() >= h.expireAt
+}
+
+// ttl 剩余有效期, 0表示永不过期
+func (h recordHeader) ttl(now time.Time) time.Duration {
+	if h.expireAt == 0 {
+		return 0
+	}
+	return time.Duration(h.expireAt - now.UnixNano())
+}
+
+func encodeRecord(h recordHeader, payload []byte) []byte {
+	var flags byte
+	if h.expireAt != 0 {
+		flags |= flagExpire
+	}
+	if h.version != 0 {
+		flags |= flagVersion
+	}
+	if h.schema != 0 {
+		flags |= flagSchema
+	}
+	if h.codec != CodecMsgpack {
+		flags |= flagCodec
+	}
+	if h.compress != 0 {
+		flags |= flagCompress
+	}
+	if h.dek != nil {
+		flags |= flagEncrypt
+	}
+	b := make([]byte, 0, 4+8+8+3*binary.MaxVarintLen64+len(h.dek)+len(payload))
+	b = append(b, recordMagic, flags)
+	if flags&flagExpire != 0 {
+		b = binary.BigEndian.AppendUint64(b, uint64(h.expireAt))
+	}
+	if flags&flagVersion != 0 {
+		b = binary.AppendUvarint(b, h.version)
+	}
+	if flags&flagSchema != 0 {
+		b = binary.AppendUvarint(b, uint64(h.schema))
+	}
+	if flags&flagCodec != 0 {
+		b = append(b, h.codec)
+	}
+	if flags&flagCompress != 0 {
+		b = append(b, h.compress)
+		if h.compress == algoZstdDict {
+			b = binary.BigEndian.AppendUint32(b, h.dict)
+		}
+	}
+	if flags&flagEncrypt != 0 {
+		b = binary.BigEndian.AppendUint32(b, h.keyID)
+		b = binary.AppendUvarint(b, uint64(len(h.dek)))
+		b = append(b, h.dek...)
+	}
+	return append(b, payload...)
+}
+
+var errShortHeader = errors.New("kvdb: truncated record header")
+
+func decodeRecord(bs []byte) (h recordHeader, payload []byte, err error) {
+	if len(bs) == 0 || bs[0] != recordMagic {
+		return h, bs, nil
+	}
+	if len(bs) < 2 {
+		return h, nil, errShortHeader
+	}
+	flags, rest := bs[1], bs[2:]
+	if flags&flagExpire != 0 {
+		if len(rest) < 8 {
+			return h, nil, errShortHeader
+		}
+		h.expireAt = int64(binary.BigEndian.Uint64(rest))
+		rest = rest[8:]
+	}
+	if flags&flagVersion != 0 {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return h, nil, errShortHeader
+		}
+		h.version, rest = v, rest[n:]
+	}
+	if flags&flagSchema != 0 {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 || v > math.MaxUint32 {
+			return h, nil, errShortHeader
+		}
+		h.schema, rest = uint32(v), rest[n:]
+	}
+	if flags&flagCodec != 0 {
+		if len(rest) < 1 {
+			return h, nil, errShortHeader
+		}
+		h.codec, rest = rest[0], rest[1:]
+	}
+	if flags&flagCompress != 0 {
+		if len(rest) < 1 {
+			return h, nil, errShortHeader
+		}
+		h.compress, rest = rest[0], rest[1:]
+		if h.compress == algoZstdDict {
+			if len(rest) < 4 {
+				return h, nil, errShortHeader
+			}
+			h.dict, rest = binary.BigEndian.Uint32(rest), rest[4:]
+		}
+	}
+	if flags&flagEncrypt != 0 {
+		if len(rest) < 4 {
+			return h, nil, errShortHeader
+		}
+		h.keyID, rest = binary.BigEndian.Uint32(rest), rest[4:]
+		n, m := binary.Uvarint(rest)
+		if m <= 0 || uint64(len(rest)-m) < n {
+			return h, nil, errShortHeader
+		}
+		h.dek, rest = rest[m:m+int(n)], rest[m+int(n):]
+	}
+	return h, rest, nil
+}
@@ -0,0 +1,151 @@
+package kvdb
+
+import (
+	"context"
+	"errors"
+)
+
+type tableMemCtx[T Entity] struct {
+	t *TableMem[T]
+}
+
+var _ TableCtx[Entity] = (*tableMemCtx[Entity])(nil)
+
+// NewTableCtx is NewTable returning the context-aware view of the table.
+func NewTableCtx[T Entity](db *DB, name string, opts ...TableOptions) (TableCtx[T], error) {
+	table, err := NewTable[T](db, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return table.Ctx(), nil
+}
+
+// Name implements TableCtx.
+func (c *tableMemCtx[T]) Name() string {
+	return c.t.name
+}
+
+// Get implements TableCtx.
+func (c *tableMemCtx[T]) Get(ctx context.Context, id string) (v T, err error) {
+	if err := ctx.Err(); err != nil {
+		return v, err
+	}
+	return c.t.getOrQuarantine(id)
+}
+
+// Gets implements TableCtx.
+func (c *tableMemCtx[T]) Gets(ctx context.Context, ids ...string) (list []T, err error) {
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return list, err
+		}
+		v, err := c.t.get(id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return list, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// Insert implements TableCtx.
+func (c *tableMemCtx[T]) Insert(ctx context.Context, id string, v *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.insert(id, v)
+}
+
+// Upsert implements TableCtx.
+func (c *tableMemCtx[T]) Upsert(ctx context.Context, id string, v *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.insert(id, v)
+}
+
+// InsertIfAbsent implements TableCtx.
+func (c *tableMemCtx[T]) InsertIfAbsent(ctx context.Context, id string, v *T) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.t.InsertIfAbsent(id, v)
+}
+
+// Save implements TableCtx.
+func (c *tableMemCtx[T]) Save(ctx context.Context, v *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.Save(v)
+}
+
+// Update implements TableCtx.
+func (c *tableMemCtx[T]) Update(ctx context.Context, id string, v H) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.update(id, v)
+}
+
+// Delete implements TableCtx.
+func (c *tableMemCtx[T]) Delete(ctx context.Context, ids ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.delete(ids...)
+}
+
+// Search implements TableCtx.
+func (c *tableMemCtx[T]) Search(ctx context.Context, key string, filter func(v T) bool, start_end ...int) (list []T, err error) {
+	return c.t.search(ctx, true, []byte(key), prefixEnd([]byte(key)), filter, start_end...)
+}
+
+// SearchByIdx implements TableCtx.
+func (c *tableMemCtx[T]) SearchByIdx(ctx context.Context, idxname string, value any, filter func(v T) bool, start_end ...int) (list []T, err error) {
+	return c.t.searchByIdx(ctx, idxname, value, filter, start_end...)
+}
+
+// RangeByIdx implements TableCtx.
+func (c *tableMemCtx[T]) RangeByIdx(ctx context.Context, idxname string, lo, hi any, opts ...RangeOptions) (list []T, err error) {
+	return c.t.rangeByIdx(ctx, idxname, lo, hi, opts...)
+}
+
+// SearchPage implements TableCtx.
+func (c *tableMemCtx[T]) SearchPage(ctx context.Context, key string, filter func(v T) bool, cursor Cursor, limit int) (Page[T], error) {
+	return c.t.searchPage(ctx, key, filter, cursor, limit)
+}
+
+// SearchByIdxPage implements TableCtx.
+func (c *tableMemCtx[T]) SearchByIdxPage(ctx context.Context, idxname string, value any, filter func(v T) bool, cursor Cursor, limit int) (Page[T], error) {
+	return c.t.searchByIdxPage(ctx, idxname, value, filter, cursor, limit)
+}
+
+// GetByUnique implements TableCtx.
+func (c *tableMemCtx[T]) GetByUnique(ctx context.Context, idxname string, value any) (v T, err error) {
+	if err := ctx.Err(); err != nil {
+		return v, err
+	}
+	return c.t.getByUnique(idxname, value)
+}
+
+// Scan implements TableCtx.
+func (c *tableMemCtx[T]) Scan(ctx context.Context, handle func(v T) bool) error {
+	return c.t.scan(ctx, true, "", func(key, id string, v T) bool { return handle(v) })
+}
+
+// Close implements TableCtx.
+func (c *tableMemCtx[T]) Close() error {
+	return c.t.close()
+}
+
+// Txn implements TableCtx.
+func (c *tableMemCtx[T]) Txn(ctx context.Context, fn func(tx Tx[T]) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.Txn(fn)
+}
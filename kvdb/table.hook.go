@@ -0,0 +1,161 @@
+package kvdb
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// 写入钩子在写入所在的事务内执行: 先设置自动时间戳, 再执行Before钩子和
+// Validate, 然后写入记录和索引, 最后执行After钩子. 任一步返回错误时整个
+// 事务回滚. 过期清理, MigrateAll和Rekey不执行钩子.
+
+// Hooks are called for every write to a table. Before hooks may modify v
+// or reject the write by returning an error; After hooks see the staged
+// write and may do further writes through tx. A write that overwrites an
+// existing record (Insert over an existing id, Update, CompareAndSwap,
+// Modify) is an update; old is the record before the write.
+//
+// Hooks run inside the write's transaction and must only use tx. To
+// touch another table, Bind it to tx.Batch(). Calling a table's own
+// write methods from a hook would start a nested transaction and fails
+// with ErrNestedTxn; its read methods do not see the staged writes.
+type Hooks[T Entity] struct {
+	BeforeInsert func(tx Tx[T], id string, v *T) error
+	AfterInsert  func(tx Tx[T], id string, v *T) error
+	BeforeUpdate func(tx Tx[T], id string, old, v *T) error
+	AfterUpdate  func(tx Tx[T], id string, old, v *T) error
+	BeforeDelete func(tx Tx[T], id string, v *T) error
+	AfterDelete  func(tx Tx[T], id string, v *T) error
+}
+
+// Validator is implemented by entities that check their own invariants.
+// Validate is called after the Before hooks; an error rejects the write
+// with ErrInvalid.
+type Validator interface {
+	Validate() error
+}
+
+// Hook implements Table. Hooks registered by several calls run in
+// registration order.
+func (t *TableMem[T]) Hook(h Hooks[T]) {
+	t.hmu.Lock()
+	defer t.hmu.Unlock()
+	t.hooks = append(t.hooks, h)
+}
+
+// Hook implements TableCtx.
+func (c *tableMemCtx[T]) Hook(h Hooks[T]) {
+	c.t.Hook(h)
+}
+
+// stampFields 检查kvdb:"createdAt"和kvdb:"updatedAt"字段的类型
+func stampFields[T any]() (created, updated string, err error) {
+	created, updated = taggedField[T]("createdAt"), taggedField[T]("updatedAt")
+	modeType := getRefTypeElem(new(T))
+	for _, name := range []string{created, updated} {
+		if name == "" {
+			continue
+		}
+		if f, _ := modeType.FieldByName(name); f.Type != reflect.TypeOf(time.Time{}) {
+			return "", "", fmt.Errorf("kvdb: timestamp field %s must be time.Time, not %s", name, f.Type)
+		}
+	}
+	return created, updated, nil
+}
+
+// hooked 写入是否需要执行钩子, 不需要时Update可以直接合并H
+func (t *TableMem[T]) hooked() bool {
+	t.hmu.RLock()
+	defer t.hmu.RUnlock()
+	_, ok := any(new(T)).(Validator)
+	return ok || len(t.hooks) > 0 || t.createdField != "" || t.updatedField != ""
+}
+
+func (t *TableMem[T]) hookList() []Hooks[T] {
+	t.hmu.RLock()
+	defer t.hmu.RUnlock()
+	return t.hooks
+}
+
+// beforeWrite 设置时间戳, 执行Before钩子和Validate. old为nil表示插入
+func (tx *txMem[T]) beforeWrite(id string, old, v *T) error {
+	if tx.nohooks {
+		return nil
+	}
+	tx.stamp(old, v, time.Now())
+	for _, h := range tx.t.hookList() {
+		var err error
+		switch {
+		case old == nil && h.BeforeInsert != nil:
+			err = h.BeforeInsert(tx, id, v)
+		case old != nil && h.BeforeUpdate != nil:
+			err = h.BeforeUpdate(tx, id, old, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if val, ok := any(v).(Validator); ok {
+		if err := val.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+	return nil
+}
+
+// afterWrite 执行After钩子
+func (tx *txMem[T]) afterWrite(id string, old, v *T) error {
+	if tx.nohooks {
+		return nil
+	}
+	for _, h := range tx.t.hookList() {
+		var err error
+		switch {
+		case old == nil && h.AfterInsert != nil:
+			err = h.AfterInsert(tx, id, v)
+		case old != nil && h.AfterUpdate != nil:
+			err = h.AfterUpdate(tx, id, old, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteHook 执行BeforeDelete钩子, after为true时执行AfterDelete钩子
+func (tx *txMem[T]) deleteHook(id string, v *T, after bool) error {
+	if tx.nohooks {
+		return nil
+	}
+	for _, h := range tx.t.hookList() {
+		fn := is(after, h.AfterDelete, h.BeforeDelete)
+		if fn == nil {
+			continue
+		}
+		if err := fn(tx, id, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stamp 设置时间戳: updatedAt总是设为now; createdAt为零值时, 插入设为now,
+// 更新保留旧记录的值
+func (tx *txMem[T]) stamp(old, v *T, now time.Time) {
+	if f := tx.t.updatedField; f != "" {
+		getRefValueElem(v).FieldByName(f).Set(reflect.ValueOf(now))
+	}
+	if f := tx.t.createdField; f != "" {
+		field := getRefValueElem(v).FieldByName(f)
+		if !field.IsZero() {
+			return
+		}
+		if old != nil {
+			field.Set(getRefValueElem(old).FieldByName(f))
+		} else {
+			field.Set(reflect.ValueOf(now))
+		}
+	}
+}
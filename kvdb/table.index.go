@@ -0,0 +1,261 @@
+package kvdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// IndexProblem is one inconsistent index entry found by VerifyIndexes.
+type IndexProblem struct {
+	Index string // 索引名
+	ID    string // 记录id
+	Key   []byte // 索引key(不含表前缀)
+}
+
+// IndexReport is the result of VerifyIndexes.
+type IndexReport struct {
+	Orphaned   []IndexProblem // 索引项指向的记录不存在, 或索引已不存在
+	Missing    []IndexProblem // 记录缺少应有的索引项
+	Mismatched []IndexProblem // 索引项与记录当前的字段值不一致
+}
+
+// OK reports whether no problem was found.
+func (r IndexReport) OK() bool {
+	return len(r.Orphaned) == 0 && len(r.Missing) == 0 && len(r.Mismatched) == 0
+}
+
+// VerifyIndexes implements Table.
+func (t *TableMem[T]) VerifyIndexes() (IndexReport, error) {
+	return t.verifyIndexes(context.Background())
+}
+
+// RebuildIndex implements Table.
+func (t *TableMem[T]) RebuildIndex(name string) error {
+	return t.rebuildIndexes(context.Background(), name)
+}
+
+// RebuildAllIndexes implements Table.
+func (t *TableMem[T]) RebuildAllIndexes() error {
+	return t.rebuildIndexes(context.Background())
+}
+
+// verifyIndexes 在同一个快照上对比索引和主记录
+func (t *TableMem[T]) verifyIndexes(ctx context.Context) (r IndexReport, err error) {
+	if t.closed.Load() {
+		return r, newError("verify", t.name, "", ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return r, newError("verify", t.name, "", err)
+	}
+	defer t.db.release()
+	snap := t.db.pdb.NewSnapshot()
+	defer snap.Close()
+
+	// 索引 -> 记录
+	err = t.rawScan(ctx, snap, t.iprefix, func(key, value []byte) error {
+		id := string(value)
+		name, _, _ := bytes.Cut(key, []byte{0x00})
+		idx, ok := t.indexs[string(name)]
+		if !ok {
+			r.Orphaned = append(r.Orphaned, IndexProblem{Index: string(name), ID: id, Key: bytes.Clone(key)})
+			return nil
+		}
+		bs, closer, err := snap.Get(t.mkey(id))
+		if errors.Is(err, pebble.ErrNotFound) {
+			r.Orphaned = append(r.Orphaned, IndexProblem{Index: idx.Name, ID: id, Key: bytes.Clone(key)})
+			return nil
+		} else if err != nil {
+			return err
+		}
+		v, _, err := t.decode(bs)
+		closer.Close()
+		if err != nil {
+			return nil // 无法解码的记录不属于索引问题
+		}
+		if want, ok := idx.entityKey(&v, id); !ok || !bytes.Equal(want, key) {
+			r.Mismatched = append(r.Mismatched, IndexProblem{Index: idx.Name, ID: id, Key: bytes.Clone(key)})
+		}
+		return nil
+	})
+	if err != nil {
+		return r, newError("verify", t.name, "", err)
+	}
+
+	// 记录 -> 索引
+	err = t.rawScan(ctx, snap, t.mprefix, func(key, value []byte) error {
+		id := string(key)
+		v, _, err := t.decode(value)
+		if err != nil {
+			return nil
+		}
+		for _, idx := range t.indexs {
+			want, ok := idx.entityKey(&v, id)
+			if !ok {
+				continue
+			}
+			bs, closer, err := snap.Get(t.ikey(want))
+			if errors.Is(err, pebble.ErrNotFound) {
+				r.Missing = append(r.Missing, IndexProblem{Index: idx.Name, ID: id, Key: want})
+				continue
+			} else if err != nil {
+				return err
+			}
+			if string(bs) != id {
+				r.Missing = append(r.Missing, IndexProblem{Index: idx.Name, ID: id, Key: want})
+			}
+			closer.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return r, newError("verify", t.name, "", err)
+	}
+	return r, nil
+}
+
+// rawScan 遍历r中以prefix开头的原始键值, key不含prefix
+func (t *TableMem[T]) rawScan(ctx context.Context, r pebble.Reader, prefix []byte, handle func(key, value []byte) error) (err error) {
+	iter, err := r.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := iter.Close(); err == nil {
+			err = e
+		}
+	}()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := handle(iter.Key()[len(prefix):], iter.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildIndexes 清空并重建索引names, 不传names时重建全部索引. 与回填一样
+// 分批进行, 每批一个事务, 期间其他写入照常进行并维护索引; 重建完成前查询
+// 这些索引返回ErrIndexBuilding.
+func (t *TableMem[T]) rebuildIndexes(ctx context.Context, names ...string) (err error) {
+	var idxs []IndexInfo
+	if len(names) == 0 {
+		for _, idx := range t.indexs {
+			idxs = append(idxs, idx)
+		}
+	}
+	for _, name := range names {
+		idx, ok := t.indexs[name]
+		if !ok {
+			return newError("rebuild", t.name, name, ErrNoIndex)
+		}
+		idxs = append(idxs, idx)
+	}
+	// 索引清空后直到重建成功都不能查询: 失败时标记为indexFailed, 可以再次重建;
+	// 清空之前失败则恢复原来的状态
+	prev := make(map[string]any)
+	var cleared bool
+	var dups []IndexProblem
+	defer func() {
+		for name, p := range prev {
+			switch {
+			case !cleared && p == nil:
+				t.building.Delete(name)
+			case !cleared:
+				t.building.Store(name, p)
+			case err != nil:
+				t.building.Store(name, &indexFailed{err: err})
+			case slices.ContainsFunc(dups, func(d IndexProblem) bool { return d.Index == name }):
+				t.building.Store(name, &indexFailed{err: &DuplicateError{Duplicates: dups}})
+			default:
+				t.building.Delete(name)
+			}
+		}
+	}()
+	for _, idx := range idxs {
+		p, loaded := t.building.LoadOrStore(idx.Name, true)
+		if _, failed := p.(*indexFailed); loaded && (!failed || !t.building.CompareAndSwap(idx.Name, p, true)) {
+			return newError("rebuild", t.name, idx.Name, ErrIndexBuilding)
+		}
+		prev[idx.Name] = p
+		if !loaded {
+			prev[idx.Name] = nil
+		}
+	}
+	err = t.Txn(func(tx Tx[T]) error {
+		return tx.(*txMem[T]).clearIndexes(idxs, len(names) == 0)
+	})
+	cleared = err == nil
+	var from []byte
+	for err == nil {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		err = t.Txn(func(tx Tx[T]) (err error) {
+			_, from, err = tx.(*txMem[T]).indexBatch(idxs, from, &dups)
+			return err
+		})
+		if from == nil {
+			break
+		}
+	}
+	if err != nil {
+		return newError("rebuild", t.name, "", fmt.Errorf("rebuild indexes: %w", err))
+	}
+	if len(dups) > 0 {
+		return newError("rebuild", t.name, "", &DuplicateError{Duplicates: dups})
+	}
+	return nil
+}
+
+// DuplicateError is returned by a rebuild that found records sharing a
+// value of a unique index. Every other record is indexed; the listed
+// ones are left out and the affected indexes cannot be queried until
+// the values are fixed and the index is rebuilt.
+type DuplicateError struct {
+	Duplicates []IndexProblem // 值与已索引的记录重复, 未写入索引项的记录
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%v: %d records duplicate an indexed value", ErrUniqueViolation, len(e.Duplicates))
+}
+
+func (e *DuplicateError) Unwrap() error {
+	return ErrUniqueViolation
+}
+
+// clearIndexes 删除idxs的所有索引项, all为true时同时清除已不存在的索引留下的索引项
+func (tx *txMem[T]) clearIndexes(idxs []IndexInfo, all bool) error {
+	t := tx.t
+	if all {
+		return tx.b.b.DeleteRange(t.iprefix, prefixEnd(t.iprefix), nil)
+	}
+	for _, idx := range idxs {
+		p := t.ikey(idx.prefix())
+		if err := tx.b.b.DeleteRange(p, prefixEnd(p), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyIndexes implements TableCtx.
+func (c *tableMemCtx[T]) VerifyIndexes(ctx context.Context) (IndexReport, error) {
+	return c.t.verifyIndexes(ctx)
+}
+
+// RebuildIndex implements TableCtx.
+func (c *tableMemCtx[T]) RebuildIndex(ctx context.Context, name string) error {
+	return c.t.rebuildIndexes(ctx, name)
+}
+
+// RebuildAllIndexes implements TableCtx.
+func (c *tableMemCtx[T]) RebuildAllIndexes(ctx context.Context) error {
+	return c.t.rebuildIndexes(ctx)
+}
@@ -0,0 +1,70 @@
+package kvdb
+
+import (
+	"context"
+	"iter"
+)
+
+// All implements Table. It yields every record as (id, value) in id
+// order; iteration stops at the first storage error. Use Ctx().All to
+// observe that error.
+func (t *TableMem[T]) All() iter.Seq2[string, T] {
+	return t.seq(context.Background(), true, nil, nil, nil)
+}
+
+// Prefix implements Table. It yields the records whose id starts with p.
+func (t *TableMem[T]) Prefix(p string) iter.Seq2[string, T] {
+	return t.seq(context.Background(), true, []byte(p), prefixEnd([]byte(p)), nil)
+}
+
+// ByIndex implements Table. It yields (id, value) of the records whose
+// index entry matches value, in index order; "*" yields the whole index.
+func (t *TableMem[T]) ByIndex(idxname string, value any) iter.Seq2[string, T] {
+	seq, _ := t.byIndex(context.Background(), idxname, value)
+	return seq
+}
+
+func (t *TableMem[T]) byIndex(ctx context.Context, idxname string, value any) (iter.Seq2[string, T], func() error) {
+	idx, err := t.index("search", idxname)
+	if err != nil {
+		return func(yield func(string, T) bool) {}, func() error { return err }
+	}
+	prefix := idx.prefix()
+	if value != "*" {
+		if prefix, err = idx.queryKey(value); err != nil {
+			err = newError("search", t.name, idxname, err)
+			return func(yield func(string, T) bool) {}, func() error { return err }
+		}
+	}
+	return t.seq(ctx, false, prefix, prefixEnd(prefix), &err), func() error { return err }
+}
+
+// seq 把scanRange包装成迭代器; pebble迭代器在range循环结束或break时关闭,
+// 扫描的错误写入errp
+func (t *TableMem[T]) seq(ctx context.Context, isMain bool, lower, upper []byte, errp *error) iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		err := t.scanRange(ctx, isMain, lower, upper, false, func(key, id string, v T) bool {
+			return yield(id, v)
+		})
+		if errp != nil {
+			*errp = err
+		}
+	}
+}
+
+// All implements TableCtx.
+func (c *tableMemCtx[T]) All(ctx context.Context) (iter.Seq2[string, T], func() error) {
+	var err error
+	return c.t.seq(ctx, true, nil, nil, &err), func() error { return err }
+}
+
+// Prefix implements TableCtx.
+func (c *tableMemCtx[T]) Prefix(ctx context.Context, p string) (iter.Seq2[string, T], func() error) {
+	var err error
+	return c.t.seq(ctx, true, []byte(p), prefixEnd([]byte(p)), &err), func() error { return err }
+}
+
+// ByIndex implements TableCtx.
+func (c *tableMemCtx[T]) ByIndex(ctx context.Context, idxname string, value any) (iter.Seq2[string, T], func() error) {
+	return c.t.byIndex(ctx, idxname, value)
+}
@@ -0,0 +1,78 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// 旧版本每个表在Dir/<name>下有两个独立的pebble存储: mdb保存id -> msgpack(T),
+// idb保存索引. 现在Dir本身是所有表共用的存储. 表第一次以新布局打开时把mdb
+// 中的记录导入主记录命名空间(旧记录没有头部, 按msgpack读取), 索引按结构体
+// 标签重建, idb不再使用. 导入后在表的元数据中记录"legacy", 之后不再导入;
+// 旧目录保持原样, 确认数据无误后可以手动删除.
+
+// importLegacy 导入Dir/<name>/mdb中的旧记录, 新布局中已有的id保留新值
+func (t *TableMem[T]) importLegacy() error {
+	if t.db.fs != vfs.Default || t.db.dir == "" {
+		return nil
+	}
+	dir := filepath.Join(t.db.dir, t.name, "mdb")
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, closer, err := t.db.pdb.Get(t.metaKey("legacy")); err == nil {
+		return closer.Close()
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		return err
+	}
+	old, err := pebble.Open(dir, &pebble.Options{ReadOnly: true, ErrorIfNotExists: true})
+	if err != nil {
+		return fmt.Errorf("import legacy %s: %w", dir, err)
+	}
+	defer old.Close()
+	iter, err := old.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	b := t.db.pdb.NewBatch()
+	defer func() { b.Close() }()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := t.mkey(string(iter.Key()))
+		if _, closer, err := t.db.pdb.Get(key); err == nil {
+			closer.Close()
+			continue
+		} else if !errors.Is(err, pebble.ErrNotFound) {
+			return err
+		}
+		if err := b.Set(key, iter.Value(), nil); err != nil {
+			return err
+		}
+		if b.Len() >= snapshotBatch {
+			if err := b.Commit(pebble.NoSync); err != nil {
+				return err
+			}
+			b.Close()
+			b = t.db.pdb.NewBatch()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("import legacy %s: %w", dir, err)
+	}
+	// 清除索引项和索引定义, syncIndexes把所有索引当作新索引回填
+	if err := errors.Join(
+		b.DeleteRange(t.iprefix, prefixEnd(t.iprefix), nil),
+		b.Delete(t.metaKey("indexes"), nil),
+		b.Set(t.metaKey("legacy"), []byte(dir), nil),
+	); err != nil {
+		return err
+	}
+	return b.Commit(pebble.Sync)
+}
@@ -1,17 +1,15 @@
 package kvdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"reflect"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/pebble"
-	"github.com/cockroachdb/pebble/vfs"
 	"github.com/dgraph-io/ristretto"
 )
 
@@ -25,69 +23,152 @@ var config = ristretto.Config{
 
 type TableMem[T Entity] struct {
 	//Table[T]
-	name   string
-	mdb    *pebble.DB
-	idb    *pebble.DB
-	cache  *ristretto.Cache
-	indexs map[string]IndexInfo
+	name         string
+	db           *DB
+	id           uint32 // 表id, 所有key的前缀
+	mprefix      []byte // 主记录key前缀
+	iprefix      []byte // 索引key前缀
+	xprefix      []byte // 过期索引key前缀
+	qprefix      []byte // 隔离记录key前缀
+	cprefix      []byte // 变更日志key前缀
+	cache        *ristretto.Cache
+	indexs       map[string]IndexInfo
+	pk           string // primaryKey字段名, 没有时为空
+	ttlField     string // kvdb:"ttl"字段名, 没有时为空
+	createdField string // kvdb:"createdAt"字段名, 没有时为空
+	updatedField string // kvdb:"updatedAt"字段名, 没有时为空
+	opts         TableOptions
+	stop         chan struct{}        // 表关闭时关闭, 停止后台任务
+	locks        [keyLocks]sync.Mutex // Modify按id分段加锁
+	building     sync.Map             // 正在后台回填的索引名
+	built        chan struct{}        // 回填结束时关闭
+	buildErr     error                // 回填失败的原因, built关闭后可读
+	codec        Codec                // 写入时使用的codec
+	wmu          sync.Mutex
+	wch          chan struct{} // 下一次提交变更时关闭, 唤醒Watch
+	mmu          sync.RWMutex
+	migrations   map[uint32]MigrateFunc // 结构版本 -> 升级到下一版本的函数
+	hmu          sync.RWMutex
+	hooks        []Hooks[T]
+	closed       atomic.Bool
 }
 
 var _ Table[Entity] = (*TableMem[Entity])(nil)
-var writerOpt = pebble.WriteOptions{Sync: true}
 
+// NewTableMem opens table name on the default DB configured by InitMem.
+// It panics if the store cannot be opened.
+//
+// Deprecated: use Open and NewTable.
 func NewTableMem[T Entity](name string) Table[T] {
+	db, err := getDefaultDB()
+	if err != nil {
+		panic(err)
+	}
+	table, err := newTableMem[T](db, name, TableOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+func newTableMem[T Entity](db *DB, name string, opts TableOptions) (*TableMem[T], error) {
+	db.omu.Lock()
+	defer db.omu.Unlock()
+	if t, ok := db.lookup(name); ok {
+		if t, ok := t.(*TableMem[T]); ok {
+			return t, nil
+		}
+		return nil, newError("open", name, "", fmt.Errorf("table is already open as %T", t))
+	}
 	cache, _ := ristretto.NewCache(&config)
 	table := TableMem[T]{
-		name:   name,
-		cache:  cache,
-		indexs: createIndexs[T](),
+		name:     name,
+		db:       db,
+		cache:    cache,
+		indexs:   createIndexs[T](),
+		pk:       primaryKeyField[T](),
+		ttlField: taggedField[T]("ttl"),
+		opts:     opts,
+		codec:    is(opts.Codec == nil, MsgpackCodec, opts.Codec),
+		stop:     make(chan struct{}),
+	}
+	if err := checkCodec[T](table.codec); err != nil {
+		return nil, newError("open", name, "", err)
+	}
+	var err error
+	if table.createdField, table.updatedField, err = stampFields[T](); err != nil {
+		return nil, newError("open", name, "", err)
+	}
+	if err := table.open(); err != nil {
+		return nil, newError("open", name, "", err)
+	}
+	if err := table.importLegacy(); err != nil {
+		return nil, newError("open", name, "", err)
+	}
+	if opts.BlindIndexes {
+		if opts.Keys == nil {
+			return nil, newError("open", name, "", errors.New("BlindIndexes needs a key provider"))
+		}
+		key, err := opts.Keys.BlindKey()
+		if err != nil {
+			return nil, newError("open", name, "", err)
+		}
+		for name, idx := range table.indexs {
+			idx.blind = key
+			table.indexs[name] = idx
+		}
+	}
+	pending, err := table.syncIndexes()
+	if err != nil {
+		return nil, newError("open", name, "", err)
+	}
+	if err := db.register(name, &table); err != nil {
+		return nil, newError("open", name, "", err)
+	}
+	table.backfill(pending)
+	if opts.SweepInterval >= 0 {
+		go table.sweeper(is(opts.SweepInterval == 0, defaultSweepInterval, opts.SweepInterval))
 	}
-	table.init()
 	fmt.Println("[TableMem][Index]", table.name)
 	for _, v := range table.indexs {
-		fmt.Printf("\t%s: %s\r\n", v.Name, v.Field)
+		fmt.Printf("\t%s: %s\r\n", v.Name, strings.Join(v.Fields, ","))
 	}
-	return &table
+	return &table, nil
 }
+
 func (t *TableMem[T]) init() {
-	if memOptions.Mem {
-		// 纯内存数据库（数据仅存于内存）
-		if db, err := pebble.Open("", &pebble.Options{
-			FS: vfs.NewMem(), // 使用内存文件系统
-		}); err == nil {
-			t.mdb = db
-		}
-		// 纯内存数据库（数据仅存于内存）
-		if db, err := pebble.Open("", &pebble.Options{
-			FS: vfs.NewMem(), // 使用内存文件系统
-		}); err == nil {
-			t.idb = db
-		}
-	} else {
-		// 纯内存数据库（数据仅存于内存）
-		if db, err := pebble.Open(filepath.Join(memOptions.Dir, t.name, "mdb"), &pebble.Options{
-			BytesPerSync: 1 << 20, // 1MB同步一次，提升写入性能
-		}); err == nil {
-			t.mdb = db
-		}
-		// 纯内存数据库（数据仅存于内存）
-		if db, err := pebble.Open(filepath.Join(memOptions.Dir, t.name, "idb"), &pebble.Options{
-			BytesPerSync: 1 << 20, // 1MB同步一次，提升写入性能
-		}); err == nil {
-			t.idb = db
-		}
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-		go func() {
-			<-sigs
-			t.mdb.Flush()
-			t.idb.Flush()
-			t.mdb.Close()
-			t.idb.Close()
-			os.Exit(0)
-		}()
+	if err := t.open(); err != nil {
+		panic(err)
+	}
+}
+
+func (t *TableMem[T]) open() error {
+	id, err := t.db.tableID(t.name)
+	if err != nil {
+		return err
 	}
+	t.id = id
+	t.mprefix = keyPrefix(id, nsMain)
+	t.iprefix = keyPrefix(id, nsIndex)
+	t.xprefix = keyPrefix(id, nsExpire)
+	t.qprefix = keyPrefix(id, nsQuarantine)
+	t.cprefix = keyPrefix(id, nsChange)
+	return nil
+}
 
+// metaKey 表元数据在pebble中的key
+func (t *TableMem[T]) metaKey(name string) []byte {
+	return append(keyPrefix(t.id, nsMeta), name...)
+}
+
+// mkey 主记录在pebble中的key
+func (t *TableMem[T]) mkey(id string) []byte {
+	return append(append(make([]byte, 0, len(t.mprefix)+len(id)), t.mprefix...), id...)
+}
+
+// ikey 索引在pebble中的key
+func (t *TableMem[T]) ikey(key []byte) []byte {
+	return append(append(make([]byte, 0, len(t.iprefix)+len(key)), t.iprefix...), key...)
 }
 
 // Name implements Table.
@@ -95,27 +176,15 @@ func (t *TableMem[T]) Name() string {
 	return t.name
 }
 
+// Ctx implements Table.
+func (t *TableMem[T]) Ctx() TableCtx[T] {
+	return &tableMemCtx[T]{t: t}
+}
+
 // Get implements Table.
 func (t *TableMem[T]) Get(id string) (v T, ok bool) {
-	if v1, o1 := t.cache.Get(id); o1 {
-		if v, ok = v1.(T); ok {
-			return v, ok
-		} else {
-			t.cache.Del(id)
-		}
-	}
-	if bs, closer, err := t.mdb.Get([]byte(id)); err == nil {
-		defer closer.Close()
-		if v, err := unmarshal[T](bs); err == nil {
-			t.cache.Set(id, v, 1)
-			//fmt.Println("get ", id, v)
-			return v, true
-		} else {
-			t.Delete(id)
-		}
-		return v, false
-	}
-	return v, false
+	v, err := t.getOrQuarantine(id)
+	return v, err == nil
 }
 
 // Gets implements Table.
@@ -130,115 +199,202 @@ func (t *TableMem[T]) Gets(ids ...string) (list []T) {
 
 // Insert implements Table.
 func (t *TableMem[T]) Insert(id string, v *T) error {
-	if json, err := marshal(v); err == nil {
-		if e1 := t.mdb.Set([]byte(id), json, &writerOpt); e1 == nil {
-			rentity := getRefValueElem(v)
-			for _, idx := range t.indexs {
-				value := rentity.FieldByName(idx.Field)
-				if value.IsValid() {
-					if value.Kind() == reflect.Ptr && value.IsNil() {
-						continue
-					}
-					key := buildIndexKey(idx, value.String(), id)
-					t.idb.Set([]byte(key), []byte(id), pebble.Sync)
-				}
-			}
-			return nil
-		} else {
-			return e1
-		}
-	} else {
+	return t.insert(id, v)
+}
+
+// Upsert implements Table.
+func (t *TableMem[T]) Upsert(id string, v *T) error {
+	return t.insert(id, v)
+}
+
+// InsertIfAbsent implements Table.
+func (t *TableMem[T]) InsertIfAbsent(id string, v *T) (inserted bool, err error) {
+	err = t.Txn(func(tx Tx[T]) (err error) {
+		inserted, err = tx.InsertIfAbsent(id, v)
 		return err
-	}
+	})
+	return inserted, err
+}
+
+// Save implements Table.
+func (t *TableMem[T]) Save(v *T) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.Save(v) })
 }
 
 // Update implements Table.
 func (t *TableMem[T]) Update(id string, entity H) error {
-	o, ok := t.Get(id)
-	if !ok {
-		return errors.New("exist " + id)
-	}
-	rstruct := getRefTypeElem(o)
-	for i := range rstruct.NumField() {
-		field := rstruct.Field(i)
-		if _, ok := entity[field.Name]; !ok {
-			delete(entity, field.Name)
-		}
+	return t.update(id, entity)
+}
+
+// Delete implements Table.
+func (t *TableMem[T]) Delete(ids ...string) {
+	t.delete(ids...)
+}
+
+// Search implements Table.
+func (t *TableMem[T]) Search(key string, filter func(t T) bool, start_end ...int) (list []T) {
+	list, _ = t.search(context.Background(), true, []byte(key), prefixEnd([]byte(key)), filter, start_end...)
+	return list
+}
+
+// SearchByIdx implements Table.
+func (t *TableMem[T]) SearchByIdx(idxname string, value any, filter func(t T) bool, start_end ...int) (list []T) {
+	list, _ = t.searchByIdx(context.Background(), idxname, value, filter, start_end...)
+	return list
+}
+
+// RangeByIdx implements Table.
+func (t *TableMem[T]) RangeByIdx(idxname string, lo, hi any, opts ...RangeOptions) (list []T) {
+	list, _ = t.rangeByIdx(context.Background(), idxname, lo, hi, opts...)
+	return list
+}
+
+// GetByUnique implements Table.
+func (t *TableMem[T]) GetByUnique(idxname string, value any) (v T, ok bool) {
+	v, err := t.getByUnique(idxname, value)
+	return v, err == nil
+}
+
+// Close implements Table.
+func (t *TableMem[T]) Close() {
+	t.close()
+}
+
+// Scan implements Table.
+func (t *TableMem[T]) Scan(handle func(v T) bool) {
+	t.scan(context.Background(), true, "", func(key, id string, v T) bool { return handle(v) })
+}
+
+func (t *TableMem[T]) get(id string) (v T, err error) {
+	if t.closed.Load() {
+		return v, newError("get", t.name, id, ErrClosed)
 	}
-	/* rentity := getRefValueElem(v)
-	for _, idx := range t.indexs {
-		value := rentity.FieldByName(idx.Field)
-		if !value.IsZero() {
-			key := buildIndexKey(idx.Name, value.String(), id)
-			if oldVal := getValue(o, idx.Field); isSameValue(value, oldVal) {
-				continue
-			} else if oldVal.IsValid() && !oldVal.IsZero() {
-				key := buildIndexKey(idx.Name, oldVal.String(), id)
-				t.idb.Delete([]byte(key), pebble.Sync)
-			}
-			t.idb.Set([]byte(key), []byte(id), &writerOpt)
+	if err := t.db.acquire(); err != nil {
+		return v, newError("get", t.name, id, err)
+	}
+	defer t.db.release()
+	if v1, o1 := t.cache.Get(id); o1 {
+		if v, ok := v1.(T); ok {
+			return v, nil
+		} else {
+			t.cache.Del(id)
 		}
-	} */
-	//rentity := getRefValueElem(o)
-	for _, idx := range t.indexs {
-		if val, ok := entity[idx.Field]; ok {
-			key := buildIndexKey(idx, fmt.Sprintf("%v", val), id)
-			if oldVal := getValue(o, idx.Field); isSameValue(val, oldVal) {
-				continue
-			} else if oldVal.IsValid() {
-				if oldVal.Kind() != reflect.Ptr ||
-					(oldVal.Kind() == reflect.Ptr && !oldVal.IsNil()) {
-					key := buildIndexKey(idx, oldVal.String(), id)
-					t.idb.Delete([]byte(key), pebble.Sync)
-				}
-			}
-			t.idb.Set([]byte(key), []byte(id), &writerOpt)
+	}
+	bs, closer, err := t.db.pdb.Get(t.mkey(id))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = ErrNotFound
 		}
+		return v, newError("get", t.name, id, err)
 	}
-
-	entity = concatEntity(&o, entity)
-	if json, err := marshal(entity); err == nil {
-		t.mdb.Set([]byte(id), json, pebble.Sync)
-		t.cache.Del(id)
-		return nil
-	} else {
-		return err
+	defer closer.Close()
+	v, h, err := t.decode(bs)
+	if err != nil {
+		return v, newError("get", t.name, id, err)
 	}
+	now := time.Now()
+	if h.expired(now) {
+		var zero T
+		return zero, newError("get", t.name, id, ErrNotFound)
+	}
+	t.cache.SetWithTTL(id, v, 1, h.ttl(now))
+	return v, nil
 }
 
-// Delete implements Table.
-func (t *TableMem[T]) Delete(ids ...string) {
-	for _, id := range ids {
-		if v, ok := t.Get(id); ok {
-			rentity := getRefValueElem(v)
-			for _, idx := range t.indexs {
-				value := rentity.FieldByName(idx.Name)
-				key := buildIndexKey(idx, value.String())
-				//itxn.Delete([]byte(key))
-				t.idb.Delete([]byte(key), pebble.Sync)
-			}
+func (t *TableMem[T]) getByUnique(idxname string, value any) (v T, err error) {
+	idx, err := t.index("get", idxname)
+	if err != nil {
+		return v, err
+	}
+	if !idx.Unique {
+		return v, newError("get", t.name, idxname, fmt.Errorf("%w: no unique index %s", ErrNoIndex, idxname))
+	}
+	key, err := idx.queryKey(value)
+	if err != nil {
+		return v, newError("get", t.name, idxname, err)
+	}
+	if t.closed.Load() {
+		return v, newError("get", t.name, idxname, ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return v, newError("get", t.name, idxname, err)
+	}
+	defer t.db.release()
+	bs, closer, err := t.db.pdb.Get(t.ikey(key))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = ErrNotFound
 		}
-		t.cache.Del(id)
-		t.mdb.Delete([]byte(id), pebble.Sync)
+		return v, newError("get", t.name, idxname, err)
 	}
+	id := string(bs)
+	closer.Close()
+	return t.get(id)
 }
 
-// Search implements Table.
-func (t *TableMem[T]) Search(key string, filter func(t T) bool, start_end ...int) (list []T) {
-	return t.search(true, key, key, filter, start_end...)
+func (t *TableMem[T]) insert(id string, v *T) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.Insert(id, v) })
 }
 
-// SearchByIdx implements Table.
-func (t *TableMem[T]) SearchByIdx(idxname string, value any, filter func(t T) bool, start_end ...int) (list []T) {
-	if i, ok := t.indexs[idxname]; ok {
-		key := buildIndexKey(i, fmt.Sprintf("%v", value))
-		return t.search(false, key, value, filter, start_end...)
+func (t *TableMem[T]) update(id string, entity H) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.Update(id, entity) })
+}
+
+func (t *TableMem[T]) delete(ids ...string) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.Delete(ids...) })
+}
+
+func (t *TableMem[T]) searchByIdx(ctx context.Context, idxname string, value any, filter func(t T) bool, start_end ...int) (list []T, err error) {
+	idx, err := t.index("search", idxname)
+	if err != nil {
+		return make([]T, 0), err
 	}
-	return make([]T, 0)
+	prefix := idx.prefix()
+	if value != "*" {
+		if prefix, err = idx.queryKey(value); err != nil {
+			return make([]T, 0), newError("search", t.name, idxname, err)
+		}
+	}
+	return t.search(ctx, false, prefix, prefixEnd(prefix), filter, start_end...)
 }
 
-// Search implements Table.
-func (t *TableMem[T]) search(isMain bool, searchKey string, value any, filter func(t T) bool, start_end ...int) (list []T) {
+func (t *TableMem[T]) rangeByIdx(ctx context.Context, idxname string, lo, hi any, opts ...RangeOptions) (list []T, err error) {
+	idx, err := t.index("range", idxname)
+	if err != nil {
+		return make([]T, 0), err
+	}
+	if idx.blind != nil {
+		return make([]T, 0), newError("range", t.name, idxname, fmt.Errorf("%w: blinded index supports equality lookups only", ErrNoIndex))
+	}
+	var o RangeOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	lower, upper := idx.prefix(), prefixEnd(idx.prefix())
+	if lo != nil {
+		if lower, err = idx.queryKey(lo); err != nil {
+			return make([]T, 0), newError("range", t.name, idxname, err)
+		}
+		if o.LoExclusive {
+			lower = prefixEnd(lower)
+		}
+	}
+	if hi != nil {
+		if upper, err = idx.queryKey(hi); err != nil {
+			return make([]T, 0), newError("range", t.name, idxname, err)
+		}
+		if !o.HiExclusive {
+			upper = prefixEnd(upper)
+		}
+	}
+	err = t.scanRange(ctx, false, lower, upper, o.Desc, func(key, id string, v T) bool {
+		list = append(list, v)
+		return o.Limit <= 0 || len(list) < o.Limit
+	})
+	return list, err
+}
+
+func (t *TableMem[T]) search(ctx context.Context, isMain bool, lower, upper []byte, filter func(t T) bool, start_end ...int) (list []T, err error) {
 	var start, end int = 0, 1
 	if len(start_end) >= 1 {
 		start = start_end[0]
@@ -254,28 +410,7 @@ func (t *TableMem[T]) search(isMain bool, searchKey string, value any, filter fu
 	}
 	size := end - start
 	curIdx := 0
-	isSearchAll := value == "*"
-	if isSearchAll {
-		searchKey = searchKey[0 : len(searchKey)-1]
-	}
-	t.scan(isMain, searchKey, &pebble.IterOptions{
-		LowerBound: []byte(searchKey),
-		//UpperBound: []byte(fmt.Sprintf("%s\xff", key)),
-	}, func(rkey string, v T) bool {
-		/* 	if !strings.HasPrefix() {
-			return false
-		} */
-		if !isSearchAll && value == "" {
-			vs := strings.Split(rkey, "-")
-			if len(vs) < 2 {
-				t.mdb.Delete([]byte(rkey), nil)
-				t.idb.Delete([]byte(rkey), nil)
-				return false
-			}
-			if vs1 := strings.Split(vs[1], _Separator); vs1[0] != value {
-				return false
-			}
-		}
+	err = t.scanRange(ctx, isMain, lower, upper, false, func(rkey, id string, v T) bool {
 		if filter(v) {
 			if curIdx < start {
 				curIdx++
@@ -288,31 +423,124 @@ func (t *TableMem[T]) search(isMain bool, searchKey string, value any, filter fu
 		}
 		return true
 	})
-	return list
+	return list, err
 }
-func (t *TableMem[T]) Close() {
-	t.mdb.Close()
-	t.idb.Close()
+
+func (t *TableMem[T]) close() error {
+	if t.closed.CompareAndSwap(false, true) {
+		close(t.stop)
+		t.db.unregister(t.name, t)
+	}
+	return nil
 }
 
-// Scan implements Table.
-func (t *TableMem[T]) Scan(handle func(v T) bool) {
-	t.scan(true, "", nil, func(key string, v T) bool { return handle(v) })
-}
-func (t *TableMem[T]) scan(isMain bool, key string, op *pebble.IterOptions, handle func(key string, v T) bool) {
-	var db *pebble.DB = is(isMain, t.mdb, t.idb)
-	// 遍历所有键值
-	iter, _ := db.NewIter(op)
-	defer iter.Close()
-	for iter.First(); iter.Valid(); iter.Next() {
-		ckey := string(iter.Key())
-		if key != "" && !strings.HasPrefix(ckey, key) {
-			break
+// decode 解析主记录的值
+func (t *TableMem[T]) decode(bs []byte) (v T, h recordHeader, err error) {
+	h, payload, err := t.unpack(bs)
+	var codec Codec
+	if err == nil {
+		codec, err = t.codecOf(h.codec)
+	}
+	if err == nil && h.schema != t.opts.SchemaVersion {
+		payload, err = t.migrate(codec, h.schema, payload)
+	}
+	if err == nil {
+		err = codec.Unmarshal(payload, &v)
+	}
+	if err != nil {
+		if errors.Is(err, errUnsupported) {
+			return v, h, fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+		return v, h, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return v, h, nil
+}
+
+// encode 编码实体, entity可以是*T或H; H先转换成T, 使任何codec都只需要处理T
+func (t *TableMem[T]) encode(entity any, h recordHeader) ([]byte, error) {
+	if patch, ok := entity.(H); ok {
+		bs, err := marshal(patch)
+		if err != nil {
+			return nil, err
 		}
+		v, err := unmarshal[T](bs)
+		if err != nil {
+			return nil, err
+		}
+		entity = &v
+	}
+	payload, err := t.codec.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	// h可能来自旧记录(Update, MigrateAll等沿用旧头部), 编码相关的字段按本次写入重新设置
+	h.codec = t.codec.ID()
+	h.compress, h.dict, h.keyID, h.dek = 0, 0, 0, nil
+	if payload, err = t.compress(&h, payload); err != nil {
+		return nil, err
+	}
+	if payload, err = t.encrypt(&h, payload); err != nil {
+		return nil, err
+	}
+	return encodeRecord(h, payload), nil
+}
+
+// unpack 解析记录头部, 解密并解压payload
+func (t *TableMem[T]) unpack(bs []byte) (recordHeader, []byte, error) {
+	h, payload, err := decodeRecord(bs)
+	if err == nil {
+		payload, err = t.decrypt(h, payload)
+	}
+	if err == nil {
+		payload, err = t.decompress(h, payload)
+	}
+	return h, payload, err
+}
+
+func (t *TableMem[T]) scan(ctx context.Context, isMain bool, key string, handle func(key, id string, v T) bool) (err error) {
+	return t.scanRange(ctx, isMain, []byte(key), prefixEnd([]byte(key)), false, handle)
+}
+
+// scanRange 遍历命名空间内[lower, upper)的记录, lower/upper不含表前缀, upper为nil时遍历到命名空间末尾
+func (t *TableMem[T]) scanRange(ctx context.Context, isMain bool, lower, upper []byte, reverse bool, handle func(key, id string, v T) bool) (err error) {
+	if t.closed.Load() {
+		return newError("scan", t.name, string(lower), ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return newError("scan", t.name, string(lower), err)
+	}
+	defer t.db.release()
+	prefix := is(isMain, t.mprefix, t.iprefix)
+	op := &pebble.IterOptions{
+		LowerBound: append(append([]byte(nil), prefix...), lower...),
+		UpperBound: prefixEnd(prefix),
+	}
+	if upper != nil {
+		op.UpperBound = append(append([]byte(nil), prefix...), upper...)
+	}
+	// 遍历表内所有键值
+	iter, err := t.db.pdb.NewIter(op)
+	if err != nil {
+		return newError("scan", t.name, string(lower), err)
+	}
+	defer func() {
+		if e := iter.Close(); err == nil && e != nil {
+			err = newError("scan", t.name, string(lower), e)
+		}
+	}()
+	first, next := iter.First, iter.Next
+	if reverse {
+		first, next = iter.Last, iter.Prev
+	}
+	for first(); iter.Valid(); next() {
+		if err := ctx.Err(); err != nil {
+			return newError("scan", t.name, string(lower), err)
+		}
+		ckey := string(iter.Key()[len(prefix):])
 		var id string = is(isMain, ckey, string(iter.Value()))
 		if v, ok := t.cache.Get(id); ok {
 			if v2, o2 := v.(T); o2 {
-				if o := handle(ckey, v2); o {
+				if o := handle(ckey, id, v2); o {
 					continue
 				} else {
 					break
@@ -322,21 +550,28 @@ func (t *TableMem[T]) scan(isMain bool, key string, op *pebble.IterOptions, hand
 			}
 		}
 		if isMain {
-			if v, err := unmarshal[T](iter.Value()); err == nil {
-				if o := handle(ckey, v); o {
+			if v, h, err := t.decode(iter.Value()); err == nil && !h.expired(time.Now()) {
+				if o := handle(ckey, id, v); o {
 					continue
 				} else {
 					break
 				}
 			}
 		} else {
-			if v, ok := t.Get(id); ok {
-				if o := handle(ckey, v); o {
+			v, err := t.get(id)
+			if err == nil {
+				if o := handle(ckey, id, v); o {
 					continue
 				} else {
 					break
 				}
+			} else if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupt) {
+				return err
 			}
 		}
 	}
+	if err := iter.Error(); err != nil {
+		return newError("scan", t.name, string(lower), err)
+	}
+	return nil
 }
@@ -0,0 +1,157 @@
+package kvdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// MigrateFunc upgrades a record from one schema version to the next. raw
+// is the record decoded as a generic msgpack map; the returned map is
+// re-encoded and decoded into T (or passed to the next migration).
+type MigrateFunc func(raw map[string]any) (map[string]any, error)
+
+const migrateBatch = 256 // MigrateAll和Rekey每个事务写回的记录数
+
+// RewriteResult is the outcome of MigrateAll and Rekey.
+type RewriteResult struct {
+	Rewritten   int // 重新编码写回的记录数
+	Quarantined int // 无法解码而被隔离的记录数
+}
+
+// Migrate implements Table.
+//
+// Records are upgraded lazily on read: a record stored with schema version
+// v < TableOptions.SchemaVersion goes through the functions registered for
+// v, v+1, ... in order. Register migrations before reading old records.
+func (t *TableMem[T]) Migrate(from uint32, fn MigrateFunc) {
+	t.mmu.Lock()
+	defer t.mmu.Unlock()
+	if t.migrations == nil {
+		t.migrations = make(map[uint32]MigrateFunc)
+	}
+	t.migrations[from] = fn
+}
+
+// errUnsupported 记录本身完好, 只是当前代码无法读取它的格式(缺少迁移函数,
+// 记录来自更新的版本或未知的codec). 这类记录不会被隔离
+var errUnsupported = errors.New("unsupported record format")
+
+// migrate 把结构版本from的payload升级到当前版本, 升级前后都用codec编码
+func (t *TableMem[T]) migrate(codec Codec, from uint32, payload []byte) ([]byte, error) {
+	to := t.opts.SchemaVersion
+	if from > to {
+		return nil, fmt.Errorf("%w: schema version %d is newer than %d", errUnsupported, from, to)
+	}
+	var raw map[string]any
+	if err := codec.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+	t.mmu.RLock()
+	defer t.mmu.RUnlock()
+	for v := from; v < to; v++ {
+		fn, ok := t.migrations[v]
+		if !ok {
+			return nil, fmt.Errorf("%w: no migration from schema version %d", errUnsupported, v)
+		}
+		var err error
+		if raw, err = fn(raw); err != nil {
+			return nil, fmt.Errorf("migrate schema version %d: %w", v, err)
+		}
+	}
+	return codec.Marshal(raw)
+}
+
+// MigrateAll implements Table.
+func (t *TableMem[T]) MigrateAll() (RewriteResult, error) {
+	return t.migrateAll(context.Background())
+}
+
+// migrateAll 把旧版本或其他codec编码的记录按当前结构和codec写回. 升级可能改变被索引的字段,
+// 而旧记录原来的索引key无法用当前结构计算, 因此有记录被升级时最后重建全部索引
+func (t *TableMem[T]) migrateAll(ctx context.Context) (RewriteResult, error) {
+	r, err := t.rewrite(ctx, "migrate", func(h recordHeader) bool {
+		return h.schema != t.opts.SchemaVersion || h.codec != t.codec.ID()
+	})
+	if err == nil && r.Rewritten > 0 {
+		err = t.rebuildIndexes(ctx)
+	}
+	return r, err
+}
+
+// rewrite 分批把stale返回true的记录按表当前的设置(结构版本, codec, 压缩, 密钥)
+// 重新编码写回. 每批一个事务, 期间其他读写照常进行. 无法解码的记录被隔离
+// 并计数, 不影响其他记录; 缺少迁移函数等当前代码无法读取的记录会中止重写
+func (t *TableMem[T]) rewrite(ctx context.Context, op string, stale func(h recordHeader) bool) (r RewriteResult, err error) {
+	var from []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return r, err
+		}
+		var next []byte
+		batchN, batchBad := 0, 0
+		err := t.Txn(func(tx Tx[T]) error {
+			txm := tx.(*txMem[T])
+			txm.quiet = true
+			next, batchN, batchBad = nil, 0, 0
+			iter, err := txm.b.b.NewIter(&pebble.IterOptions{
+				LowerBound: append(append([]byte(nil), t.mprefix...), from...),
+				UpperBound: prefixEnd(t.mprefix),
+			})
+			if err != nil {
+				return err
+			}
+			defer iter.Close()
+			batch := 0
+			for iter.First(); iter.Valid(); iter.Next() {
+				key := iter.Key()[len(t.mprefix):]
+				if batch == migrateBatch {
+					next = append([]byte(nil), key...)
+					return nil
+				}
+				batch++
+				h, _, err := decodeRecord(iter.Value())
+				if err == nil && !stale(h) {
+					continue
+				}
+				v, h, err := t.decode(iter.Value())
+				if errors.Is(err, errUnsupported) {
+					return newError(op, t.name, string(key), err)
+				} else if err != nil {
+					if err := txm.moveToQuarantine(string(key), bytes.Clone(iter.Value()), err); err != nil {
+						return err
+					}
+					batchBad++
+					continue
+				}
+				if err := txm.write(string(key), &v, h, h); err != nil {
+					return err
+				}
+				batchN++
+			}
+			return iter.Error()
+		})
+		if err != nil {
+			return r, newError(op, t.name, "", err)
+		}
+		r.Rewritten += batchN
+		r.Quarantined += batchBad
+		if next == nil {
+			return r, nil
+		}
+		from = next
+	}
+}
+
+// Migrate implements TableCtx.
+func (c *tableMemCtx[T]) Migrate(from uint32, fn MigrateFunc) {
+	c.t.Migrate(from, fn)
+}
+
+// MigrateAll implements TableCtx.
+func (c *tableMemCtx[T]) MigrateAll(ctx context.Context) (RewriteResult, error) {
+	return c.t.migrateAll(ctx)
+}
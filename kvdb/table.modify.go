@@ -0,0 +1,88 @@
+package kvdb
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const keyLocks = 64 // Modify的锁分段数
+
+var keyLockSeed = maphash.MakeSeed()
+
+// keyLock 返回id所在分段的锁
+func (t *TableMem[T]) keyLock(id string) *sync.Mutex {
+	return &t.locks[maphash.String(keyLockSeed, id)%keyLocks]
+}
+
+// Modify implements Table.
+//
+// fn runs outside the store's write lock on a copy of the record, so it
+// may be slow without blocking writers of other records. Concurrent
+// Modify calls on the same id are serialized by a per-key lock; if
+// another write (Update, Insert, ...) changes the record while fn runs,
+// the record is reloaded and fn is called again. An error from fn aborts
+// without writing.
+func (t *TableMem[T]) Modify(id string, fn func(v *T) error) error {
+	return t.modify(context.Background(), id, fn)
+}
+
+func (t *TableMem[T]) modify(ctx context.Context, id string, fn func(v *T) error) error {
+	mu := t.keyLock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next, version, err := t.getWithVersion(id)
+		if err != nil {
+			return err
+		}
+		if err := fn(&next); err != nil {
+			return err
+		}
+		err = t.Txn(func(tx Tx[T]) error {
+			txm := tx.(*txMem[T])
+			// 重新解码得到旧值: fn可能改动了next中指针, 切片或map指向的数据
+			cur, h, err := txm.load(id)
+			if err != nil {
+				return newError("modify", t.name, id, err)
+			}
+			if h.version != version {
+				return newError("modify", t.name, id, ErrConflict)
+			}
+			return newError("modify", t.name, id, txm.swap(id, &cur, h, &next))
+		})
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+}
+
+// Modify implements Tx. fn runs inside the transaction.
+func (tx *txMem[T]) Modify(id string, fn func(v *T) error) error {
+	cur, h, err := tx.load(id)
+	if err == nil && h.expired(time.Now()) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return newError("modify", tx.t.name, id, err)
+	}
+	// 浅拷贝会与cur共享指针, 切片和map, 另外解码一份交给fn
+	next, _, err := tx.load(id)
+	if err != nil {
+		return newError("modify", tx.t.name, id, err)
+	}
+	if err := fn(&next); err != nil {
+		return err
+	}
+	return newError("modify", tx.t.name, id, tx.swap(id, &cur, h, &next))
+}
+
+// Modify implements TableCtx.
+func (c *tableMemCtx[T]) Modify(ctx context.Context, id string, fn func(v *T) error) error {
+	return c.t.modify(ctx, id, fn)
+}
@@ -0,0 +1,94 @@
+package kvdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+)
+
+const defaultPageSize = 100
+
+// Cursor is an opaque continuation token returned in Page.Next. Passing
+// it back resumes the scan right after the last returned record; the
+// empty Cursor starts from the beginning.
+type Cursor string
+
+// Page is one page of a paginated search. Next is empty on the last page.
+type Page[T Entity] struct {
+	Items []T
+	Next  Cursor
+}
+
+func encodeCursor(key string) Cursor {
+	return Cursor(base64.RawURLEncoding.EncodeToString([]byte(key)))
+}
+
+func (c Cursor) decode() ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil {
+		return nil, fmt.Errorf("kvdb: invalid cursor: %v", err)
+	}
+	return key, nil
+}
+
+// SearchPage implements Table.
+func (t *TableMem[T]) SearchPage(key string, filter func(v T) bool, cursor Cursor, limit int) Page[T] {
+	page, _ := t.searchPage(context.Background(), key, filter, cursor, limit)
+	return page
+}
+
+// SearchByIdxPage implements Table.
+func (t *TableMem[T]) SearchByIdxPage(idxname string, value any, filter func(v T) bool, cursor Cursor, limit int) Page[T] {
+	page, _ := t.searchByIdxPage(context.Background(), idxname, value, filter, cursor, limit)
+	return page
+}
+
+func (t *TableMem[T]) searchPage(ctx context.Context, key string, filter func(v T) bool, cursor Cursor, limit int) (Page[T], error) {
+	return t.page(ctx, true, []byte(key), prefixEnd([]byte(key)), filter, cursor, limit)
+}
+
+func (t *TableMem[T]) searchByIdxPage(ctx context.Context, idxname string, value any, filter func(v T) bool, cursor Cursor, limit int) (Page[T], error) {
+	idx, err := t.index("search", idxname)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	prefix := idx.prefix()
+	if value != "*" {
+		if prefix, err = idx.queryKey(value); err != nil {
+			return Page[T]{}, newError("search", t.name, idxname, err)
+		}
+	}
+	return t.page(ctx, false, prefix, prefixEnd(prefix), filter, cursor, limit)
+}
+
+// page 从cursor之后的key开始扫描, 多读一条匹配的记录来判断是否还有下一页
+func (t *TableMem[T]) page(ctx context.Context, isMain bool, lower, upper []byte, filter func(v T) bool, cursor Cursor, limit int) (page Page[T], err error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if cursor != "" {
+		last, err := cursor.decode()
+		if err != nil {
+			return page, newError("search", t.name, string(cursor), err)
+		}
+		if bytes.Compare(last, lower) < 0 || (upper != nil && bytes.Compare(last, upper) >= 0) {
+			return page, newError("search", t.name, string(cursor), fmt.Errorf("kvdb: invalid cursor: outside of the searched range"))
+		}
+		lower = append(last, 0x00) // 紧接在last之后的key
+	}
+	var lastKey string
+	err = t.scanRange(ctx, isMain, lower, upper, false, func(key, id string, v T) bool {
+		if filter != nil && !filter(v) {
+			return true
+		}
+		if len(page.Items) == limit {
+			page.Next = encodeCursor(lastKey)
+			return false
+		}
+		page.Items = append(page.Items, v)
+		lastKey = key
+		return true
+	})
+	return page, err
+}
@@ -0,0 +1,299 @@
+package kvdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Get遇到无法解码的记录时返回ErrCorrupt, 并把原始值移到隔离命名空间,
+// 之后该id按不存在处理. 修复结构或迁移函数后可用RestoreQuarantine恢复.
+// 因缺少迁移函数而无法读取的记录只返回ErrCorrupt, 不隔离. 扫描和查询只
+// 跳过无法解码的记录, 不移动它们.
+
+// QuarantineEntry is a record that was moved out of its table because it
+// could not be decoded.
+type QuarantineEntry struct {
+	ID     string
+	Raw    []byte    // 原始值, 含记录头
+	Reason string    // 解码错误
+	At     time.Time // 隔离时间
+}
+
+type quarantined struct {
+	Raw    []byte
+	Reason string
+	At     int64
+}
+
+func (t *TableMem[T]) qkey(id string) []byte {
+	return append(append([]byte(nil), t.qprefix...), id...)
+}
+
+// getOrQuarantine get, 记录无法解码时隔离
+func (t *TableMem[T]) getOrQuarantine(id string) (v T, err error) {
+	v, err = t.get(id)
+	if errors.Is(err, ErrCorrupt) && !errors.Is(err, errUnsupported) {
+		t.quarantine(id, err)
+	}
+	return v, err
+}
+
+// quarantine 记录仍是同一个无法解码的值时才移动, 期间被重写的记录不受影响
+func (t *TableMem[T]) quarantine(id string, reason error) error {
+	return t.Txn(func(tx Tx[T]) error {
+		b := tx.(*txMem[T]).b
+		bs, closer, err := b.b.Get(t.mkey(id))
+		if err != nil {
+			return err
+		}
+		raw := bytes.Clone(bs)
+		closer.Close()
+		if _, _, err := t.decode(raw); err == nil || errors.Is(err, errUnsupported) {
+			return nil
+		}
+		return tx.(*txMem[T]).moveToQuarantine(id, raw, reason)
+	})
+}
+
+// moveToQuarantine 把原始值raw移到隔离命名空间
+func (tx *txMem[T]) moveToQuarantine(id string, raw []byte, reason error) error {
+	t, b := tx.t, tx.b.b
+	val, err := marshal(quarantined{Raw: raw, Reason: reason.Error(), At: time.Now().UnixNano()})
+	if err != nil {
+		return err
+	}
+	if err := b.Set(t.qkey(id), val, nil); err != nil {
+		return err
+	}
+	tx.touch(id)
+	if err := b.Delete(t.mkey(id), nil); err != nil {
+		return err
+	}
+	if err := tx.dropIndexEntries(id, raw); err != nil {
+		return err
+	}
+	if h, _, err := decodeRecord(raw); err == nil && h.expireAt != 0 {
+		if err := b.Delete(t.xkey(h.expireAt, id), nil); err != nil {
+			return err
+		}
+	}
+	// 对Watch来说记录被删除了; MigrateAll等quiet的重写也要记录
+	quiet := tx.quiet
+	tx.quiet = false
+	defer func() { tx.quiet = quiet }()
+	return tx.logChange(OpDelete, id, raw, nil)
+}
+
+// dropIndexEntries 删除所有指向id的索引项. 记录无法解码为T, 先按通用map
+// 解码计算各索引的key; 无法解码, 缺少索引字段或算出的key不指向id时, 按值
+// 扫描整个索引命名空间
+func (tx *txMem[T]) dropIndexEntries(id string, raw []byte) error {
+	if keys, ok := tx.t.candidateKeys(id, raw); ok {
+		for _, key := range keys {
+			owner, found, err := tx.indexOwner(key)
+			if err != nil {
+				return err
+			}
+			if !found || owner != id {
+				return tx.scanIndexEntries(id)
+			}
+		}
+		for _, key := range keys {
+			if err := tx.b.b.Delete(tx.t.ikey(key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return tx.scanIndexEntries(id)
+}
+
+// candidateKeys 按通用map解码raw, 计算记录在各索引中的key
+func (t *TableMem[T]) candidateKeys(id string, raw []byte) (keys [][]byte, ok bool) {
+	h, payload, err := t.unpack(raw)
+	if err != nil {
+		return nil, false
+	}
+	codec, err := t.codecOf(h.codec)
+	if err != nil {
+		return nil, false
+	}
+	var m map[string]any
+	if err := codec.Unmarshal(payload, &m); err != nil {
+		return nil, false
+	}
+	for _, idx := range t.indexs {
+		for _, f := range idx.Fields {
+			if _, ok := m[f]; !ok {
+				return nil, false
+			}
+		}
+		key, ok, err := idx.patchKey(new(T), H(m), id)
+		if err != nil {
+			return nil, false
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, true
+}
+
+// scanIndexEntries 扫描整个索引命名空间, 删除值为id的索引项
+func (tx *txMem[T]) scanIndexEntries(id string) error {
+	iter, err := tx.b.b.NewIter(&pebble.IterOptions{LowerBound: tx.t.iprefix, UpperBound: prefixEnd(tx.t.iprefix)})
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		if string(iter.Value()) == id {
+			keys = append(keys, bytes.Clone(iter.Key()))
+		}
+	}
+	if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.b.b.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine implements Table.
+func (t *TableMem[T]) Quarantine() ([]QuarantineEntry, error) {
+	return t.listQuarantine(context.Background())
+}
+
+// InspectQuarantine implements Table.
+func (t *TableMem[T]) InspectQuarantine(id string) (map[string]any, error) {
+	e, err := t.quarantined(id)
+	if err != nil {
+		return nil, err
+	}
+	h, payload, err := t.unpack(e.Raw)
+	var codec Codec
+	if err == nil {
+		codec, err = t.codecOf(h.codec)
+	}
+	var raw map[string]any
+	if err == nil {
+		err = codec.Unmarshal(payload, &raw)
+	}
+	if err != nil {
+		return nil, newError("inspect", t.name, id, fmt.Errorf("%w: %v", ErrCorrupt, err))
+	}
+	return raw, nil
+}
+
+// RestoreQuarantine implements Table.
+//
+// With v == nil the raw value is decoded again (after T was fixed or a
+// migration was registered) and written back; it fails with ErrCorrupt
+// if it still cannot be decoded. Otherwise v replaces the record. The
+// original expiry is kept either way.
+func (t *TableMem[T]) RestoreQuarantine(id string, v *T) error {
+	return t.Txn(func(tx Tx[T]) error {
+		txm := tx.(*txMem[T])
+		bs, closer, err := txm.b.b.Get(t.qkey(id))
+		if err != nil {
+			if errors.Is(err, pebble.ErrNotFound) {
+				err = ErrNotFound
+			}
+			return newError("restore", t.name, id, err)
+		}
+		var e quarantined
+		err = msgpack.Unmarshal(bs, &e)
+		closer.Close()
+		if err != nil {
+			return newError("restore", t.name, id, fmt.Errorf("%w: %v", ErrCorrupt, err))
+		}
+		h, _, _ := decodeRecord(e.Raw)
+		if v == nil {
+			val, _, err := t.decode(e.Raw)
+			if err != nil {
+				return newError("restore", t.name, id, err)
+			}
+			v = &val
+		}
+		if err := txm.put(id, v, recordHeader{expireAt: h.expireAt}); err != nil {
+			return newError("restore", t.name, id, err)
+		}
+		return txm.b.b.Delete(t.qkey(id), nil)
+	})
+}
+
+func (t *TableMem[T]) quarantined(id string) (e QuarantineEntry, err error) {
+	if t.closed.Load() {
+		return e, newError("inspect", t.name, id, ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return e, newError("inspect", t.name, id, err)
+	}
+	defer t.db.release()
+	bs, closer, err := t.db.pdb.Get(t.qkey(id))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = ErrNotFound
+		}
+		return e, newError("inspect", t.name, id, err)
+	}
+	defer closer.Close()
+	return t.quarantineEntry(id, bs)
+}
+
+func (t *TableMem[T]) quarantineEntry(id string, bs []byte) (QuarantineEntry, error) {
+	var q quarantined
+	if err := msgpack.Unmarshal(bs, &q); err != nil {
+		return QuarantineEntry{}, newError("inspect", t.name, id, fmt.Errorf("%w: %v", ErrCorrupt, err))
+	}
+	return QuarantineEntry{ID: id, Raw: q.Raw, Reason: q.Reason, At: time.Unix(0, q.At)}, nil
+}
+
+func (t *TableMem[T]) listQuarantine(ctx context.Context) (list []QuarantineEntry, err error) {
+	if t.closed.Load() {
+		return nil, newError("inspect", t.name, "", ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return nil, newError("inspect", t.name, "", err)
+	}
+	defer t.db.release()
+	err = t.rawScan(ctx, t.db.pdb, t.qprefix, func(key, value []byte) error {
+		e, err := t.quarantineEntry(string(key), value)
+		if err != nil {
+			return err
+		}
+		list = append(list, e)
+		return nil
+	})
+	return list, newError("inspect", t.name, "", err)
+}
+
+// Quarantine implements TableCtx.
+func (c *tableMemCtx[T]) Quarantine(ctx context.Context) ([]QuarantineEntry, error) {
+	return c.t.listQuarantine(ctx)
+}
+
+// InspectQuarantine implements TableCtx.
+func (c *tableMemCtx[T]) InspectQuarantine(ctx context.Context, id string) (map[string]any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.t.InspectQuarantine(id)
+}
+
+// RestoreQuarantine implements TableCtx.
+func (c *tableMemCtx[T]) RestoreQuarantine(ctx context.Context, id string, v *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.RestoreQuarantine(id, v)
+}
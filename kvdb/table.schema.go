@@ -0,0 +1,250 @@
+package kvdb
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 表的索引定义持久化在元数据"indexes"中. 打开表时与结构体标签对比:
+// 已删除或定义改变的索引项被清除, 新增或改变的索引在后台按批回填. 回填
+// 期间该索引上的查询返回ErrIndexBuilding, 写入照常维护该索引, 因此回填
+// 和并发写入的结果一致.
+
+const backfillBatch = 512 // 每个事务回填的记录数
+
+// IndexProgress reports the progress of a background index backfill.
+type IndexProgress struct {
+	Indexes  []string // 正在回填的索引
+	Records  int      // 已处理的记录数
+	Total    int      // 开始回填时的记录数
+	Finished bool     // 回填完成, 索引可以查询
+	Err      error    // 回填失败, 之后不再回调
+}
+
+// indexDef 持久化的索引定义
+type indexDef struct {
+	Name   string
+	Fields []string
+	Unique bool
+	Blind  bool
+}
+
+func (idx IndexInfo) def() indexDef {
+	return indexDef{Name: idx.Name, Fields: idx.Fields, Unique: idx.Unique, Blind: idx.blind != nil}
+}
+
+func (d indexDef) equal(o indexDef) bool {
+	return d.Name == o.Name && d.Unique == o.Unique && d.Blind == o.Blind && slices.Equal(d.Fields, o.Fields)
+}
+
+// index 返回可以查询的索引
+func (t *TableMem[T]) index(op, name string) (IndexInfo, error) {
+	idx, ok := t.indexs[name]
+	if !ok {
+		return idx, newError(op, t.name, name, ErrNoIndex)
+	}
+	if v, ok := t.building.Load(name); ok {
+		if f, failed := v.(*indexFailed); failed {
+			return idx, newError(op, t.name, name, fmt.Errorf("%w: last build failed: %v", ErrIndexBuilding, f.err))
+		}
+		return idx, newError(op, t.name, name, ErrIndexBuilding)
+	}
+	return idx, nil
+}
+
+// indexFailed 标记回填或重建失败的索引, 索引项不完整, 重建成功前不能查询
+type indexFailed struct {
+	err error
+}
+
+func (t *TableMem[T]) loadIndexDefs(r pebble.Reader) (defs []indexDef, found bool, err error) {
+	bs, closer, err := r.Get(t.metaKey("indexes"))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer closer.Close()
+	if err := msgpack.Unmarshal(bs, &defs); err != nil {
+		return nil, false, fmt.Errorf("%w: index catalog: %v", ErrCorrupt, err)
+	}
+	return defs, true, nil
+}
+
+func (t *TableMem[T]) storeIndexDefs(b *pebble.Batch, defs []indexDef) error {
+	slices.SortFunc(defs, func(a, b indexDef) int { return cmp.Compare(a.Name, b.Name) })
+	bs, err := marshal(defs)
+	if err != nil {
+		return err
+	}
+	return b.Set(t.metaKey("indexes"), bs, nil)
+}
+
+// syncIndexes 对比持久化的索引定义和结构体标签, 清除已删除的索引项,
+// 返回需要回填的索引
+func (t *TableMem[T]) syncIndexes() (pending []IndexInfo, err error) {
+	err = t.Txn(func(tx Tx[T]) error {
+		b := tx.(*txMem[T]).b.b
+		defs, _, err := t.loadIndexDefs(b)
+		if err != nil {
+			return err
+		}
+		var kept []indexDef
+		for _, d := range defs {
+			if idx, ok := t.indexs[d.Name]; ok && idx.def().equal(d) {
+				kept = append(kept, d)
+				continue
+			}
+			p := t.ikey(append([]byte(d.Name), 0x00))
+			if err := b.DeleteRange(p, prefixEnd(p), nil); err != nil {
+				return err
+			}
+		}
+		for _, idx := range t.indexs {
+			if !slices.ContainsFunc(kept, func(d indexDef) bool { return d.Name == idx.Name }) {
+				pending = append(pending, idx)
+			}
+		}
+		return t.storeIndexDefs(b, kept)
+	})
+	slices.SortFunc(pending, func(a, b IndexInfo) int { return cmp.Compare(a.Name, b.Name) })
+	return pending, err
+}
+
+// backfill 回填pending. 第一批在调用方同步执行, 小表在打开时即可完成;
+// 其余批次在后台执行
+func (t *TableMem[T]) backfill(pending []IndexInfo) {
+	t.built = make(chan struct{})
+	if len(pending) == 0 {
+		close(t.built)
+		return
+	}
+	p := IndexProgress{}
+	for _, idx := range pending {
+		t.building.Store(idx.Name, true)
+		p.Indexes = append(p.Indexes, idx.Name)
+	}
+	t.rawScan(context.Background(), t.db.pdb, t.mprefix, func(key, value []byte) error {
+		p.Total++
+		return nil
+	})
+	next, err := t.backfillBatch(pending, nil, &p)
+	if err != nil || next == nil {
+		t.finishBackfill(pending, p, err)
+		return
+	}
+	go func() {
+		for next != nil && err == nil {
+			select {
+			case <-t.stop:
+				err = ErrClosed
+			default:
+				next, err = t.backfillBatch(pending, next, &p)
+			}
+		}
+		t.finishBackfill(pending, p, err)
+	}()
+}
+
+// backfillBatch 从主记录key from开始回填一批, 返回下一批的起点, 全部完成时
+// 返回nil并登记索引定义
+func (t *TableMem[T]) backfillBatch(pending []IndexInfo, from []byte, p *IndexProgress) (next []byte, err error) {
+	n := 0
+	err = t.Txn(func(tx Tx[T]) (err error) {
+		txm := tx.(*txMem[T])
+		if n, next, err = txm.indexBatch(pending, from, nil); err != nil || next != nil {
+			return err
+		}
+		defs, _, err := t.loadIndexDefs(txm.b.b)
+		if err != nil {
+			return err
+		}
+		for _, idx := range pending {
+			defs = append(defs, idx.def())
+		}
+		return t.storeIndexDefs(txm.b.b, defs)
+	})
+	if err != nil {
+		return nil, newError("backfill", t.name, "", err)
+	}
+	p.Records += n
+	if next != nil && t.opts.OnIndexProgress != nil {
+		t.opts.OnIndexProgress(*p)
+	}
+	return next, nil
+}
+
+// indexBatch 为从主记录key from开始的最多backfillBatch条记录写入idxs的索引项,
+// 返回处理的条数和下一批的起点, 没有更多记录时next为nil. dups不为nil时, 与
+// 其他记录重复的唯一索引值记入dups并跳过, 否则返回ErrUniqueViolation
+func (tx *txMem[T]) indexBatch(idxs []IndexInfo, from []byte, dups *[]IndexProblem) (n int, next []byte, err error) {
+	t := tx.t
+	iter, err := tx.b.b.NewIter(&pebble.IterOptions{
+		LowerBound: append(append([]byte(nil), t.mprefix...), from...),
+		UpperBound: prefixEnd(t.mprefix),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()[len(t.mprefix):]
+		if n == backfillBatch {
+			return n, append([]byte(nil), key...), nil
+		}
+		n++
+		id := string(key)
+		v, _, err := t.decode(iter.Value())
+		if err != nil {
+			continue
+		}
+		for _, idx := range idxs {
+			k, ok := idx.entityKey(&v, id)
+			if !ok {
+				continue
+			}
+			err := tx.applyIndexes(id, []indexChange{{idx: idx, newKey: k}})
+			if dups != nil && errors.Is(err, ErrUniqueViolation) {
+				*dups = append(*dups, IndexProblem{Index: idx.Name, ID: id, Key: k})
+				continue
+			}
+			if err != nil {
+				return n, nil, err
+			}
+		}
+	}
+	return n, nil, iter.Error()
+}
+
+func (t *TableMem[T]) finishBackfill(pending []IndexInfo, p IndexProgress, err error) {
+	for _, idx := range pending {
+		if err == nil {
+			t.building.Delete(idx.Name)
+		} else {
+			t.building.Store(idx.Name, &indexFailed{err: err})
+		}
+	}
+	p.Finished = err == nil
+	p.Err = err
+	t.buildErr = err
+	close(t.built)
+	if t.opts.OnIndexProgress != nil {
+		t.opts.OnIndexProgress(p)
+	}
+}
+
+// WaitIndexes implements TableCtx.
+func (c *tableMemCtx[T]) WaitIndexes(ctx context.Context) error {
+	select {
+	case <-c.t.built:
+		return c.t.buildErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,149 @@
+package kvdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const (
+	defaultSweepInterval = time.Minute
+	sweepBatch           = 256 // 每个事务最多删除的过期记录数
+)
+
+// InsertWithTTL implements Table.
+func (t *TableMem[T]) InsertWithTTL(id string, v *T, ttl time.Duration) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.InsertWithTTL(id, v, ttl) })
+}
+
+// xkey 过期索引在pebble中的key: 过期时间 + id
+func (t *TableMem[T]) xkey(expireAt int64, id string) []byte {
+	key := binary.BigEndian.AppendUint64(append([]byte(nil), t.xprefix...), uint64(expireAt))
+	return append(key, id...)
+}
+
+// fieldExpireAt 根据kvdb:"ttl"字段计算过期时间
+func (t *TableMem[T]) fieldExpireAt(entity any, now time.Time) int64 {
+	if t.ttlField == "" {
+		return 0
+	}
+	return expireAtOf(getValue(entity, t.ttlField), now)
+}
+
+// expireAtOf time.Duration字段表示从写入起的有效期, time.Time字段表示过期时刻
+func expireAtOf(v reflect.Value, now time.Time) int64 {
+	if !v.IsValid() || !v.CanInterface() {
+		return 0
+	}
+	switch x := v.Interface().(type) {
+	case time.Duration:
+		if x > 0 {
+			return now.Add(x).UnixNano()
+		}
+	case time.Time:
+		if !x.IsZero() {
+			return x.UnixNano()
+		}
+	}
+	return 0
+}
+
+// sweeper 后台定期删除过期记录, 表关闭时退出
+func (t *TableMem[T]) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.sweep(context.Background())
+		}
+	}
+}
+
+// sweep 删除所有已过期的记录及其索引, 返回删除的条数
+func (t *TableMem[T]) sweep(ctx context.Context) (n int, err error) {
+	for {
+		entries, err := t.expiredEntries(time.Now())
+		if err != nil || len(entries) == 0 {
+			return n, err
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		err = t.Txn(func(tx Tx[T]) error {
+			txm := tx.(*txMem[T])
+			txm.nohooks = true
+			for _, e := range entries {
+				// 过期索引可能已过时(记录被覆盖), 只删除过期时间一致的记录
+				if _, h, err := txm.load(e.id); err == nil && h.expireAt == e.expireAt {
+					if err := txm.Delete(e.id); err != nil {
+						return err
+					}
+					n++
+				} else if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupt) {
+					return err
+				}
+				if err := txm.b.b.Delete(t.xkey(e.expireAt, e.id), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+type expireEntry struct {
+	expireAt int64
+	id       string
+}
+
+// expiredEntries 读取最多sweepBatch条在now之前过期的过期索引
+func (t *TableMem[T]) expiredEntries(now time.Time) (entries []expireEntry, err error) {
+	if t.closed.Load() {
+		return nil, newError("sweep", t.name, "", ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return nil, newError("sweep", t.name, "", err)
+	}
+	defer t.db.release()
+	iter, err := t.db.pdb.NewIter(&pebble.IterOptions{
+		LowerBound: t.xprefix,
+		UpperBound: t.xkey(now.UnixNano()+1, ""),
+	})
+	if err != nil {
+		return nil, newError("sweep", t.name, "", err)
+	}
+	for iter.First(); iter.Valid() && len(entries) < sweepBatch; iter.Next() {
+		key := iter.Key()[len(t.xprefix):]
+		entries = append(entries, expireEntry{
+			expireAt: int64(binary.BigEndian.Uint64(key)),
+			id:       string(key[8:]),
+		})
+	}
+	if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+		return nil, newError("sweep", t.name, "", err)
+	}
+	return entries, nil
+}
+
+// InsertWithTTL implements TableCtx.
+func (c *tableMemCtx[T]) InsertWithTTL(ctx context.Context, id string, v *T, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.InsertWithTTL(id, v, ttl)
+}
+
+// Sweep implements TableCtx.
+func (c *tableMemCtx[T]) Sweep(ctx context.Context) (int, error) {
+	return c.t.sweep(ctx)
+}
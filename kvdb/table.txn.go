@@ -0,0 +1,538 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Tx stages writes against a single table. Reads inside a transaction
+// see the transaction's own uncommitted writes.
+type Tx[T Entity] interface {
+	Get(id string) (v T, err error)                            //获取,包含本事务未提交的写入
+	GetWithVersion(id string) (v T, version uint64, err error) //获取记录和版本号
+	Insert(id string, v *T) error                              //插入, id已存在时覆盖
+	Upsert(id string, v *T) error                              //插入或覆盖, 同Insert
+	InsertIfAbsent(id string, v *T) (inserted bool, err error) //id不存在时插入
+	InsertWithTTL(id string, v *T, ttl time.Duration) error    //插入, ttl后过期
+	Save(v *T) error                                           //按primaryKey字段插入或覆盖
+	Update(id string, v H) error                               //更新
+	UpdateIf(id string, version uint64, v H) error             //版本号等于version时更新, 否则返回ErrConflict
+	CompareAndSwap(id string, old, new *T) error               //当前值等于old时替换为new, 否则返回ErrConflict; old为nil时仅在不存在时插入
+	Modify(id string, fn func(v *T) error) error               //读取记录, 由fn修改后写回
+	Delete(ids ...string) error                                //删除
+	Batch() *Batch                                             //事务所在的batch, 用Bind在同一事务中读写其他表
+}
+
+type txMem[T Entity] struct {
+	t       *TableMem[T]
+	b       *Batch
+	quiet   bool // 不写变更日志, 用于MigrateAll/Rekey等不改变值的重写
+	nohooks bool // 不执行钩子, 用于过期清理
+}
+
+// Txn runs fn inside a transaction. Main-record and index mutations are
+// staged in one pebble batch and committed atomically when fn returns
+// nil; any error from fn discards them. Use DB.Txn with Bind to span
+// several tables.
+func (t *TableMem[T]) Txn(fn func(tx Tx[T]) error) error {
+	if t.closed.Load() {
+		return newError("txn", t.name, "", ErrClosed)
+	}
+	return t.db.Txn(func(b *Batch) error {
+		return fn(t.bind(b))
+	})
+}
+
+func (t *TableMem[T]) bind(b *Batch) *txMem[T] {
+	return &txMem[T]{t: t, b: b}
+}
+
+// Batch implements Tx.
+func (tx *txMem[T]) Batch() *Batch {
+	return tx.b
+}
+
+// touch 提交后清除缓存
+func (tx *txMem[T]) touch(id string) {
+	tx.b.onCommit = append(tx.b.onCommit, func() { tx.t.cache.Del(id) })
+}
+
+// Get implements Tx.
+func (tx *txMem[T]) Get(id string) (v T, err error) {
+	v, h, err := tx.load(id)
+	if err == nil && h.expired(time.Now()) {
+		err = newError("get", tx.t.name, id, ErrNotFound)
+	}
+	return v, err
+}
+
+// load 读取记录和头部, 不过滤已过期的记录
+func (tx *txMem[T]) load(id string) (v T, h recordHeader, err error) {
+	bs, closer, err := tx.b.b.Get(tx.t.mkey(id))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = ErrNotFound
+		}
+		return v, h, newError("get", tx.t.name, id, err)
+	}
+	defer closer.Close()
+	if v, h, err = tx.t.decode(bs); err != nil {
+		return v, h, newError("get", tx.t.name, id, err)
+	}
+	return v, h, nil
+}
+
+// Insert implements Tx.
+func (tx *txMem[T]) Insert(id string, v *T) error {
+	return tx.insert(id, v, 0)
+}
+
+// InsertWithTTL implements Tx.
+func (tx *txMem[T]) InsertWithTTL(id string, v *T, ttl time.Duration) error {
+	return tx.insert(id, v, ttl)
+}
+
+// Upsert implements Tx.
+func (tx *txMem[T]) Upsert(id string, v *T) error {
+	return tx.insert(id, v, 0)
+}
+
+// InsertIfAbsent implements Tx.
+func (tx *txMem[T]) InsertIfAbsent(id string, v *T) (bool, error) {
+	_, h, err := tx.load(id)
+	switch {
+	case err == nil && !h.expired(time.Now()):
+		return false, nil
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return false, newError("insert", tx.t.name, id, err)
+	}
+	if err := tx.insert(id, v, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// insert 插入或覆盖, 覆盖时删除旧记录的索引和过期索引; ttl>0时覆盖ttl字段
+func (tx *txMem[T]) insert(id string, v *T, ttl time.Duration) error {
+	now := time.Now()
+	h := recordHeader{expireAt: tx.t.fieldExpireAt(v, now)}
+	if ttl > 0 {
+		h.expireAt = now.Add(ttl).UnixNano()
+	}
+	return newError("insert", tx.t.name, id, tx.put(id, v, h))
+}
+
+// put 用v覆盖记录id(不存在时插入), 替换旧记录的索引和过期索引
+func (tx *txMem[T]) put(id string, v *T, h recordHeader) error {
+	var old *T
+	cur, oldH, err := tx.load(id)
+	switch {
+	case err == nil:
+		old = &cur
+	case errors.Is(err, ErrCorrupt):
+		// 旧记录无法解码, 无法得知其索引, 直接覆盖
+		oldH = recordHeader{}
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+	return tx.replace(id, old, oldH, v, h)
+}
+
+// replace 用v整体替换记录, old为nil表示没有旧记录; 按新旧实体的差异维护索引,
+// 按新旧头部维护过期索引, 并分配新的版本号
+func (tx *txMem[T]) replace(id string, old *T, oldH recordHeader, v *T, h recordHeader) error {
+	if err := tx.beforeWrite(id, old, v); err != nil {
+		return err
+	}
+	var changes []indexChange
+	for _, idx := range tx.t.indexs {
+		newKey, _ := idx.entityKey(v, id)
+		var oldKey []byte
+		if old != nil {
+			oldKey, _ = idx.entityKey(old, id)
+		}
+		if bytes.Equal(newKey, oldKey) {
+			continue
+		}
+		changes = append(changes, indexChange{idx: idx, oldKey: oldKey, newKey: newKey})
+	}
+	if err := tx.applyIndexes(id, changes); err != nil {
+		return err
+	}
+	if err := tx.write(id, v, oldH, h); err != nil {
+		return err
+	}
+	return tx.afterWrite(id, old, v)
+}
+
+// write 写入主记录和过期索引, entity可以是*T或H
+func (tx *txMem[T]) write(id string, entity any, oldH, h recordHeader) (err error) {
+	if h.version, err = tx.incr("ver"); err != nil {
+		return err
+	}
+	h.schema = tx.t.opts.SchemaVersion
+	json, err := tx.t.encode(entity, h)
+	if err != nil {
+		return err
+	}
+	var old []byte
+	if tx.t.opts.ChangeLog > 0 {
+		if old, err = tx.raw(id); err != nil {
+			return err
+		}
+	}
+	if err := tx.b.b.Set(tx.t.mkey(id), json, nil); err != nil {
+		return err
+	}
+	if err := tx.setExpire(id, oldH.expireAt, h.expireAt); err != nil {
+		return err
+	}
+	tx.touch(id)
+	return tx.logChange(is(old == nil, OpInsert, OpUpdate), id, old, json)
+}
+
+// setExpire 维护过期索引, 旧的过期时间old被new替换
+func (tx *txMem[T]) setExpire(id string, old, new int64) error {
+	if old == new {
+		return nil
+	}
+	if old != 0 {
+		if err := tx.b.b.Delete(tx.t.xkey(old, id), nil); err != nil {
+			return err
+		}
+	}
+	if new != 0 {
+		return tx.b.b.Set(tx.t.xkey(new, id), nil, nil)
+	}
+	return nil
+}
+
+// Save implements Tx.
+func (tx *txMem[T]) Save(v *T) error {
+	if tx.t.pk == "" {
+		return newError("save", tx.t.name, "", ErrNoKey)
+	}
+	field := getRefValueElem(v).FieldByName(tx.t.pk)
+	id, err := tx.primaryKey(field)
+	if err != nil {
+		return newError("save", tx.t.name, "", err)
+	}
+	return tx.Insert(id, v)
+}
+
+// primaryKey 读取主键字段, 为零值时生成新id并写回字段
+func (tx *txMem[T]) primaryKey(field reflect.Value) (string, error) {
+	if !field.IsZero() {
+		return fmt.Sprintf("%v", field.Interface()), nil
+	}
+	isInt := field.CanInt() || field.CanUint()
+	if tx.t.opts.IDKind == IDSequence || isInt {
+		if field.Kind() != reflect.String && !isInt {
+			return "", fmt.Errorf("kvdb: cannot store a sequence id in %s", field.Type())
+		}
+		n, err := tx.incr("seq")
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case field.CanInt():
+			field.SetInt(int64(n))
+		case field.CanUint():
+			field.SetUint(n)
+		default:
+			field.SetString(strconv.FormatUint(n, 10))
+		}
+		return strconv.FormatUint(n, 10), nil
+	}
+	if field.Kind() != reflect.String {
+		return "", fmt.Errorf("kvdb: cannot store a generated id in %s", field.Type())
+	}
+	id := is(tx.t.opts.IDKind == IDUUIDv7, newUUIDv7(), newULID())
+	field.SetString(id)
+	return id, nil
+}
+
+// incr 在事务内递增表的计数器name并返回新值, 事务回滚时计数器也回滚.
+// "seq"用于IDSequence主键, "ver"用于记录版本号
+func (tx *txMem[T]) incr(name string) (uint64, error) {
+	key := tx.t.metaKey(name)
+	var n uint64
+	bs, closer, err := tx.b.b.Get(key)
+	if err == nil {
+		n = binary.BigEndian.Uint64(bs)
+		closer.Close()
+	} else if !errors.Is(err, pebble.ErrNotFound) {
+		return 0, err
+	}
+	n++
+	if err := tx.b.b.Set(key, binary.BigEndian.AppendUint64(nil, n), nil); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Update implements Tx.
+func (tx *txMem[T]) Update(id string, entity H) error {
+	return tx.update(id, entity, nil)
+}
+
+// UpdateIf implements Tx.
+func (tx *txMem[T]) UpdateIf(id string, version uint64, entity H) error {
+	return tx.update(id, entity, &version)
+}
+
+// update version不为nil时要求记录的当前版本号等于*version
+func (tx *txMem[T]) update(id string, entity H, version *uint64) error {
+	o, h, err := tx.load(id)
+	if err == nil && h.expired(time.Now()) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return newError("update", tx.t.name, id, err)
+	}
+	if version != nil && h.version != *version {
+		return newError("update", tx.t.name, id, fmt.Errorf("%w: version %d, expected %d", ErrConflict, h.version, *version))
+	}
+	if tx.t.hooked() {
+		return newError("update", tx.t.name, id, tx.updateHooked(id, o, h, entity))
+	}
+	var changes []indexChange
+	for _, idx := range tx.t.indexs {
+		touched := false
+		for f := range entity {
+			touched = touched || idx.hasField(f)
+		}
+		if !touched {
+			continue
+		}
+		key, _, err := idx.patchKey(&o, entity, id)
+		if err != nil {
+			return newError("update", tx.t.name, id, err)
+		}
+		oldKey, _ := idx.entityKey(&o, id)
+		if bytes.Equal(key, oldKey) {
+			continue
+		}
+		changes = append(changes, indexChange{idx: idx, oldKey: oldKey, newKey: key})
+	}
+	if err := tx.applyIndexes(id, changes); err != nil {
+		return newError("update", tx.t.name, id, err)
+	}
+	newH := h
+	if val, ok := entity[tx.t.ttlField]; ok && tx.t.ttlField != "" {
+		rv, err := convertValue(val, getValue(&o, tx.t.ttlField).Type())
+		if err != nil {
+			return newError("update", tx.t.name, id, err)
+		}
+		newH.expireAt = expireAtOf(rv, time.Now())
+	}
+	entity = concatEntity(&o, entity)
+	if err := tx.write(id, entity, h, newH); err != nil {
+		return newError("update", tx.t.name, id, err)
+	}
+	return nil
+}
+
+// updateHooked 把H合并到旧记录o得到完整的实体, 按整体替换写入, 以便执行钩子
+func (tx *txMem[T]) updateHooked(id string, o T, h recordHeader, entity H) error {
+	bs, err := marshal(concatEntity(&o, entity))
+	if err != nil {
+		return err
+	}
+	v, err := unmarshal[T](bs)
+	if err != nil {
+		return err
+	}
+	newH := h
+	if _, ok := entity[tx.t.ttlField]; ok && tx.t.ttlField != "" {
+		newH.expireAt = tx.t.fieldExpireAt(&v, time.Now())
+	}
+	return tx.replace(id, &o, h, &v, newH)
+}
+
+// GetWithVersion implements Tx.
+func (tx *txMem[T]) GetWithVersion(id string) (v T, version uint64, err error) {
+	v, h, err := tx.load(id)
+	if err == nil && h.expired(time.Now()) {
+		err = newError("get", tx.t.name, id, ErrNotFound)
+	}
+	return v, h.version, err
+}
+
+// CompareAndSwap implements Tx. old == nil expects the record to be
+// absent: new is inserted if id does not exist and ErrConflict is
+// returned if it does.
+func (tx *txMem[T]) CompareAndSwap(id string, old, new *T) error {
+	if old == nil {
+		inserted, err := tx.InsertIfAbsent(id, new)
+		if err == nil && !inserted {
+			err = ErrConflict
+		}
+		return newError("cas", tx.t.name, id, err)
+	}
+	cur, h, err := tx.load(id)
+	if err == nil && h.expired(time.Now()) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return newError("cas", tx.t.name, id, err)
+	}
+	if !reflect.DeepEqual(cur, *old) {
+		return newError("cas", tx.t.name, id, ErrConflict)
+	}
+	if err := tx.swap(id, &cur, h, new); err != nil {
+		return newError("cas", tx.t.name, id, err)
+	}
+	return nil
+}
+
+// swap 用new替换当前值cur, 有kvdb:"ttl"字段时按new重新计算过期时间
+func (tx *txMem[T]) swap(id string, cur *T, h recordHeader, new *T) error {
+	newH := h
+	if tx.t.ttlField != "" {
+		newH.expireAt = tx.t.fieldExpireAt(new, time.Now())
+	}
+	return tx.replace(id, cur, h, new, newH)
+}
+
+// Delete implements Tx.
+func (tx *txMem[T]) Delete(ids ...string) error {
+	for _, id := range ids {
+		if err := tx.delete(id); err != nil {
+			return newError("delete", tx.t.name, id, err)
+		}
+	}
+	return nil
+}
+
+// delete 删除记录及其索引和过期索引; 记录无法解码时只删除主记录
+func (tx *txMem[T]) delete(id string) error {
+	o, h, err := tx.load(id)
+	loaded := err == nil
+	if loaded {
+		if err := tx.deleteHook(id, &o, false); err != nil {
+			return err
+		}
+		var changes []indexChange
+		for _, idx := range tx.t.indexs {
+			if key, ok := idx.entityKey(&o, id); ok {
+				changes = append(changes, indexChange{idx: idx, oldKey: key})
+			}
+		}
+		if err := tx.applyIndexes(id, changes); err != nil {
+			return err
+		}
+		if err := tx.setExpire(id, h.expireAt, 0); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	var old []byte
+	if tx.t.opts.ChangeLog > 0 {
+		if old, err = tx.raw(id); err != nil {
+			return err
+		}
+	}
+	if err := tx.b.b.Delete(tx.t.mkey(id), nil); err != nil {
+		return err
+	}
+	tx.touch(id)
+	if old != nil {
+		if err := tx.logChange(OpDelete, id, old, nil); err != nil {
+			return err
+		}
+	}
+	if !loaded {
+		return nil
+	}
+	return tx.deleteHook(id, &o, true)
+}
+
+// indexChange 一条记录在一个索引上的变化, oldKey/newKey为nil表示没有旧/新索引
+type indexChange struct {
+	idx    IndexInfo
+	oldKey []byte
+	newKey []byte
+}
+
+// applyIndexes 先检查所有唯一索引再写入, 检查失败时不写入任何索引
+func (tx *txMem[T]) applyIndexes(id string, changes []indexChange) error {
+	for _, c := range changes {
+		if c.newKey == nil || !c.idx.Unique {
+			continue
+		}
+		owner, ok, err := tx.indexOwner(c.newKey)
+		if err != nil {
+			return err
+		}
+		if !ok || owner == id {
+			continue
+		}
+		// 索引项指向的记录已不存在(例如被隔离)时, 值视为空闲; 已过期但尚未清理
+		// 的记录在同一个事务里按过期清理删除
+		_, h, err := tx.load(owner)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			continue
+		case err == nil && h.expired(time.Now()):
+			if err := tx.expire(owner); err != nil {
+				return err
+			}
+			continue
+		case err != nil && !errors.Is(err, ErrCorrupt):
+			return err
+		}
+		return fmt.Errorf("%w: %s already used by %s", ErrUniqueViolation, c.idx.Name, owner)
+	}
+	for _, c := range changes {
+		if c.oldKey != nil {
+			if c.idx.Unique {
+				// 唯一索引的key不含id, 只删除属于自己的
+				if owner, ok, err := tx.indexOwner(c.oldKey); err != nil {
+					return err
+				} else if !ok || owner != id {
+					continue
+				}
+			}
+			if err := tx.b.b.Delete(tx.t.ikey(c.oldKey), nil); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range changes {
+		if c.newKey != nil {
+			if err := tx.b.b.Set(tx.t.ikey(c.newKey), []byte(id), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expire 删除已过期的记录, 与过期清理一样不执行钩子
+func (tx *txMem[T]) expire(id string) error {
+	nohooks := tx.nohooks
+	tx.nohooks = true
+	defer func() { tx.nohooks = nohooks }()
+	return tx.delete(id)
+}
+
+// indexOwner 返回索引key指向的记录id
+func (tx *txMem[T]) indexOwner(key []byte) (string, bool, error) {
+	bs, closer, err := tx.b.b.Get(tx.t.ikey(key))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer closer.Close()
+	return string(bs), true, nil
+}
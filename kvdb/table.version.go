@@ -0,0 +1,80 @@
+package kvdb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// 每次写入都会给记录分配新的版本号, 版本号来自表内递增的计数器, 因此删除后
+// 重新插入的记录也不会复用旧版本号. 版本号配合UpdateIf实现乐观并发控制.
+
+// GetWithVersion implements Table.
+func (t *TableMem[T]) GetWithVersion(id string) (v T, version uint64, ok bool) {
+	v, version, err := t.getWithVersion(id)
+	return v, version, err == nil
+}
+
+// UpdateIf implements Table.
+func (t *TableMem[T]) UpdateIf(id string, version uint64, entity H) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.UpdateIf(id, version, entity) })
+}
+
+// CompareAndSwap implements Table.
+func (t *TableMem[T]) CompareAndSwap(id string, old, new *T) error {
+	return t.Txn(func(tx Tx[T]) error { return tx.CompareAndSwap(id, old, new) })
+}
+
+// getWithVersion 缓存中没有版本号, 直接读pebble
+func (t *TableMem[T]) getWithVersion(id string) (v T, version uint64, err error) {
+	if t.closed.Load() {
+		return v, 0, newError("get", t.name, id, ErrClosed)
+	}
+	if err := t.db.acquire(); err != nil {
+		return v, 0, newError("get", t.name, id, err)
+	}
+	defer t.db.release()
+	bs, closer, err := t.db.pdb.Get(t.mkey(id))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = ErrNotFound
+		}
+		return v, 0, newError("get", t.name, id, err)
+	}
+	defer closer.Close()
+	v, h, err := t.decode(bs)
+	if err != nil {
+		return v, 0, newError("get", t.name, id, err)
+	}
+	if h.expired(time.Now()) {
+		var zero T
+		return zero, 0, newError("get", t.name, id, ErrNotFound)
+	}
+	return v, h.version, nil
+}
+
+// GetWithVersion implements TableCtx.
+func (c *tableMemCtx[T]) GetWithVersion(ctx context.Context, id string) (v T, version uint64, err error) {
+	if err := ctx.Err(); err != nil {
+		return v, 0, err
+	}
+	return c.t.getWithVersion(id)
+}
+
+// UpdateIf implements TableCtx.
+func (c *tableMemCtx[T]) UpdateIf(ctx context.Context, id string, version uint64, v H) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.UpdateIf(id, version, v)
+}
+
+// CompareAndSwap implements TableCtx.
+func (c *tableMemCtx[T]) CompareAndSwap(ctx context.Context, id string, old, new *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.t.CompareAndSwap(id, old, new)
+}
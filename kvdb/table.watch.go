@@ -0,0 +1,293 @@
+package kvdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 开启TableOptions.ChangeLog后, 每次写入都在同一个事务里追加一条变更日志:
+// key是表内递增的序号, 值是写入前后记录的原始值(与主记录一样经过编码,
+// 压缩和加密). 只保留最近ChangeLog条. Watch先回放日志, 再等待新的提交.
+
+// Op is the kind of change reported by Watch.
+type Op byte
+
+const (
+	OpInsert Op = iota + 1 // 新增记录
+	OpUpdate               // 覆盖或更新已有记录
+	OpDelete               // 删除记录, 包括过期清理
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpInsert:
+		return "insert"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("Op(%d)", byte(op))
+}
+
+// Event is one committed change. Seq increases by one per change within
+// a table; pass the last handled Seq+1 as WatchFilter.From to resume.
+type Event[T Entity] struct {
+	Seq uint64
+	Op  Op
+	ID  string
+	Old *T    // 写入前的值, OpInsert时为nil
+	New *T    // 写入后的值, OpDelete时为nil
+	Err error // 值无法解码, 或From之前的日志已被删除(ErrCompacted)
+}
+
+// WatchFilter selects the events delivered by Watch.
+type WatchFilter struct {
+	From   uint64 // 从该序号开始(含), 0表示只接收Watch之后的变更
+	Prefix string // 只接收id以Prefix开头的记录
+	Ops    []Op   // 只接收这些类型, 为空时接收全部
+}
+
+func (f WatchFilter) match(op Op, id string) bool {
+	return (len(f.Ops) == 0 || slices.Contains(f.Ops, op)) && strings.HasPrefix(id, f.Prefix)
+}
+
+// change 持久化的变更日志
+type change struct {
+	Op  byte
+	ID  string
+	Old []byte
+	New []byte
+}
+
+func (t *TableMem[T]) ckey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), t.cprefix...), seq)
+}
+
+// raw 返回记录在本事务中的原始值, 不存在时返回nil
+func (tx *txMem[T]) raw(id string) ([]byte, error) {
+	bs, closer, err := tx.b.b.Get(tx.t.mkey(id))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return bytes.Clone(bs), nil
+}
+
+// logChange 追加变更日志并删除超出保留条数的旧日志, 提交后通知Watch
+func (tx *txMem[T]) logChange(op Op, id string, old, new []byte) error {
+	keep := tx.t.opts.ChangeLog
+	if keep <= 0 || tx.quiet {
+		return nil
+	}
+	seq, err := tx.incr("log")
+	if err != nil {
+		return err
+	}
+	val, err := marshal(change{Op: byte(op), ID: id, Old: old, New: new})
+	if err != nil {
+		return err
+	}
+	if err := tx.b.b.Set(tx.t.ckey(seq), val, nil); err != nil {
+		return err
+	}
+	if seq > uint64(keep) {
+		if err := tx.b.b.Delete(tx.t.ckey(seq-uint64(keep)), nil); err != nil {
+			return err
+		}
+	}
+	tx.b.onCommit = append(tx.b.onCommit, tx.t.notify)
+	return nil
+}
+
+// changed 返回在下一次提交变更时关闭的channel
+func (t *TableMem[T]) changed() <-chan struct{} {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.wch == nil {
+		t.wch = make(chan struct{})
+	}
+	return t.wch
+}
+
+func (t *TableMem[T]) notify() {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if t.wch != nil {
+		close(t.wch)
+		t.wch = nil
+	}
+}
+
+// Watch implements Table.
+//
+// The channel is closed when ctx is done or the table is closed. A slow
+// consumer does not lose events: they are read from the change log as the
+// consumer catches up, unless more than ChangeLog newer changes were
+// committed in between, in which case an event with ErrCompacted is sent
+// and delivery continues from the oldest retained change.
+func (t *TableMem[T]) Watch(ctx context.Context, filter WatchFilter) <-chan Event[T] {
+	out := make(chan Event[T])
+	fail := func(err error) <-chan Event[T] {
+		go func() {
+			defer close(out)
+			select {
+			case out <- Event[T]{Err: newError("watch", t.name, "", err)}:
+			case <-ctx.Done():
+			}
+		}()
+		return out
+	}
+	if t.opts.ChangeLog <= 0 {
+		return fail(errors.New("change log is disabled"))
+	}
+	// 起点在返回前确定, 调用Watch之后的写入都不会漏掉
+	next := filter.From
+	if next == 0 {
+		last, err := t.lastSeq()
+		if err != nil {
+			return fail(err)
+		}
+		next = last + 1
+	}
+	go func() {
+		defer close(out)
+		for {
+			wake := t.changed()
+			var err error
+			if next, err = t.replay(ctx, filter, next, out); err != nil {
+				return
+			}
+			select {
+			case <-wake:
+			case <-ctx.Done():
+				return
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// lastSeq 已提交的最后一条变更日志的序号
+func (t *TableMem[T]) lastSeq() (uint64, error) {
+	if err := t.db.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.db.release()
+	bs, closer, err := t.db.pdb.Get(t.metaKey("log"))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	return binary.BigEndian.Uint64(bs), nil
+}
+
+const watchBatch = 256 // Watch每次从日志读取的条数
+
+type seqChange struct {
+	seq uint64
+	c   change
+	err error
+}
+
+// replay 发送序号不小于next的日志, 返回下一个要读取的序号. 发送时不持有DB,
+// 消费者阻塞不会妨碍DB.Close
+func (t *TableMem[T]) replay(ctx context.Context, filter WatchFilter, next uint64, out chan<- Event[T]) (uint64, error) {
+	send := func(e Event[T]) error {
+		select {
+		case out <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.stop:
+			return ErrClosed
+		}
+	}
+	for {
+		changes, err := t.readChanges(next)
+		if err != nil || len(changes) == 0 {
+			return next, err
+		}
+		for _, sc := range changes {
+			if sc.seq > next {
+				err := newError("watch", t.name, "", fmt.Errorf("%w: changes %d..%d", ErrCompacted, next, sc.seq-1))
+				if err := send(Event[T]{Seq: next, Err: err}); err != nil {
+					return next, err
+				}
+			}
+			next = sc.seq + 1
+			if sc.err != nil {
+				if err := send(Event[T]{Seq: sc.seq, Err: sc.err}); err != nil {
+					return next, err
+				}
+				continue
+			}
+			if !filter.match(Op(sc.c.Op), sc.c.ID) {
+				continue
+			}
+			if err := send(t.event(sc.seq, sc.c)); err != nil {
+				return next, err
+			}
+		}
+	}
+}
+
+// readChanges 读取从序号from开始的最多watchBatch条日志
+func (t *TableMem[T]) readChanges(from uint64) (list []seqChange, err error) {
+	if err := t.db.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.db.release()
+	iter, err := t.db.pdb.NewIter(&pebble.IterOptions{LowerBound: t.ckey(from), UpperBound: prefixEnd(t.cprefix)})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid() && len(list) < watchBatch; iter.Next() {
+		sc := seqChange{seq: binary.BigEndian.Uint64(iter.Key()[len(t.cprefix):])}
+		if err := msgpack.Unmarshal(iter.Value(), &sc.c); err != nil {
+			sc.err = newError("watch", t.name, "", fmt.Errorf("%w: change %d: %v", ErrCorrupt, sc.seq, err))
+		}
+		list = append(list, sc)
+	}
+	return list, iter.Error()
+}
+
+// event 解码变更前后的值
+func (t *TableMem[T]) event(seq uint64, c change) Event[T] {
+	e := Event[T]{Seq: seq, Op: Op(c.Op), ID: c.ID}
+	for _, p := range []struct {
+		raw []byte
+		v   **T
+	}{{c.Old, &e.Old}, {c.New, &e.New}} {
+		if p.raw == nil {
+			continue
+		}
+		v, _, err := t.decode(p.raw)
+		if err != nil {
+			e.Err = newError("watch", t.name, c.ID, err)
+			continue
+		}
+		*p.v = &v
+	}
+	return e
+}
+
+// Watch implements TableCtx.
+func (c *tableMemCtx[T]) Watch(ctx context.Context, filter WatchFilter) <-chan Event[T] {
+	return c.t.Watch(ctx, filter)
+}